@@ -17,16 +17,24 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 
 	populator_machinery "github.com/kubernetes-csi/lib-volume-populator/populator-machinery"
 )
@@ -42,29 +50,74 @@ var version = "unknown"
 func main() {
 	var (
 		mode         string
+		pvcFile      string
+		scFile       string
+		sourceFile   string
 		fileName     string
 		fileContents string
 		httpEndpoint string
 		metricsPath  string
+		sourceLabels bool
+		sourceStatus bool
 		masterURL    string
 		kubeconfig   string
 		imageName    string
 		showVersion  bool
 		namespace    string
+		workers      int
+		maxAttempts  int
+		retryBackoff time.Duration
+		logLines     int64
+		timeout      time.Duration
+		changePolicy string
+		primeLabels  string
+		primeAnnos   string
+		sweepOrphans bool
+		orphansGrace time.Duration
+		sweepDryRun  bool
+
+		leaderElection              bool
+		leaderElectionNamespace     string
+		leaderElectionLeaseDuration time.Duration
+		leaderElectionRenewDeadline time.Duration
+		leaderElectionRetryPeriod   time.Duration
 	)
 	klog.InitFlags(nil)
 	// Main arg
-	flag.StringVar(&mode, "mode", "", "Mode to run in (controller, populate)")
+	flag.StringVar(&mode, "mode", "", "Mode to run in (controller, populate, render)")
 	// Populate args
 	flag.StringVar(&fileName, "file-name", "", "File name to populate")
 	flag.StringVar(&fileContents, "file-contents", "", "Contents to populate file with")
+	// Render args
+	flag.StringVar(&pvcFile, "pvc", "", "YAML file with the PVC to render the populator pod and PVC' for")
+	flag.StringVar(&scFile, "storage-class", "", "YAML file with the StorageClass of the PVC, if it has one")
+	flag.StringVar(&sourceFile, "data-source", "", "YAML file with the Hello data source of the PVC")
 	// Controller args
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&imageName, "image-name", "", "Image to use for populating")
+	flag.IntVar(&workers, "workers", 1, "Number of PVCs to populate concurrently")
+	flag.IntVar(&maxAttempts, "max-attempts", 0, "Number of failed populator pods after which a population is given up. 0 retries forever.")
+	flag.DurationVar(&timeout, "population-timeout", 0, "How long populating a volume may take before it is retried. Hello data sources can override it with an annotation. 0 means no limit.")
+	flag.Int64Var(&logLines, "failure-log-lines", 0, "Number of log lines of a failed populator pod to include in the failure event. 0 disables reading logs.")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 0, "Delay before retrying a failed population, doubled after every further failure.")
 	// Metrics args
-	flag.StringVar(&httpEndpoint, "http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including metrics and leader election health check, will listen (example: `:8080`). The default is empty string, which means the server is disabled.")
+	flag.StringVar(&httpEndpoint, "http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including metrics, health and readiness checks, will listen (example: `:8080`). The default is empty string, which means the server is disabled.")
 	flag.StringVar(&metricsPath, "metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
+	flag.BoolVar(&sourceStatus, "data-source-status", false, "Write the population status to the status of the Hello data sources.")
+	flag.StringVar(&changePolicy, "data-source-change-policy", "pin", "What to do when a data source changes during population: pin to keep going with the old version, restart to start over.")
+	flag.StringVar(&primeLabels, "pvc-prime-labels", "", "Comma separated keys of the PVC labels to copy to PVC'. * copies all labels.")
+	flag.StringVar(&primeAnnos, "pvc-prime-annotations", "", "Comma separated keys of the PVC annotations to copy to PVC'. * copies all annotations, except the Kubernetes ones.")
+	flag.BoolVar(&sweepOrphans, "sweep-orphans", false, "Periodically delete populator pods and PVCs whose PVC was deleted.")
+	flag.DurationVar(&orphansGrace, "orphan-grace-period", 10*time.Minute, "How old a populator pod or PVC without its PVC has to be before it is deleted.")
+	flag.BoolVar(&sweepDryRun, "sweep-orphans-dry-run", false, "Only report orphaned populator pods and PVCs instead of deleting them.")
+	flag.BoolVar(&sourceLabels, "metrics-source-labels", false, "Add data source group, kind and storage class labels to the metrics.")
+	// Leader election args
+	flag.BoolVar(&leaderElection, "leader-election", false, "Enable leader election.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "Namespace where the leader election resource lives. Defaults to the controller namespace.")
+	flag.DurationVar(&leaderElectionLeaseDuration, "leader-election-lease-duration", 15*time.Second, "Duration, in seconds, that non-leader candidates will wait to force acquire leadership.")
+	flag.DurationVar(&leaderElectionRenewDeadline, "leader-election-renew-deadline", 10*time.Second, "Duration, in seconds, that the acting leader will retry refreshing leadership before giving up.")
+	flag.DurationVar(&leaderElectionRetryPeriod, "leader-election-retry-period", 5*time.Second, "Duration, in seconds, the LeaderElector clients should wait between tries of actions.")
 	// Other args
 	flag.BoolVar(&showVersion, "version", false, "display the version string")
 	flag.StringVar(&namespace, "namespace", "hello", "Namespace to deploy controller")
@@ -75,27 +128,89 @@ func main() {
 		os.Exit(0)
 	}
 
+	const (
+		groupName  = "hello.example.com"
+		apiVersion = "v1alpha1"
+		kind       = "Hello"
+		resource   = "hellos"
+	)
+	var (
+		gk  = schema.GroupKind{Group: groupName, Kind: kind}
+		gvr = schema.GroupVersionResource{Group: groupName, Version: apiVersion, Resource: resource}
+	)
+	cfg := populator_machinery.VolumePopulatorConfig{
+		MasterURL:           masterURL,
+		Kubeconfig:          kubeconfig,
+		ImageName:           imageName,
+		HttpEndpoint:        httpEndpoint,
+		MetricsPath:         metricsPath,
+		MetricsSourceLabels: sourceLabels,
+		DataSourceStatus:    sourceStatus,
+		Namespace:           namespace,
+		Prefix:              prefix,
+		Gk:                  gk,
+		Gvr:                 gvr,
+		MountPath:           mountPath,
+		DevicePath:          devicePath,
+		PopulatorArgs:       getPopulatorPodArgs,
+		Workers:             workers,
+		RetryPolicy: populator_machinery.RetryPolicy{
+			MaxAttempts: maxAttempts,
+			Backoff:     retryBackoff,
+		},
+		PopulationTimeout:      timeout,
+		FailureLogLines:        logLines,
+		DataSourceChangePolicy: populator_machinery.DataSourceChangePolicy(changePolicy),
+		PvcPrime: populator_machinery.PvcPrimeConfig{
+			Labels:      splitKeys(primeLabels),
+			Annotations: splitKeys(primeAnnos),
+		},
+		OrphanSweeper: populator_machinery.OrphanSweeperConfig{
+			Enabled:     sweepOrphans,
+			GracePeriod: orphansGrace,
+			DryRun:      sweepDryRun,
+		},
+		LeaderElection: populator_machinery.LeaderElectionConfig{
+			Enabled:       leaderElection,
+			Namespace:     leaderElectionNamespace,
+			LeaseDuration: leaderElectionLeaseDuration,
+			RenewDeadline: leaderElectionRenewDeadline,
+			RetryPeriod:   leaderElectionRetryPeriod,
+		},
+	}
+
 	switch mode {
 	case "controller":
-		const (
-			groupName  = "hello.example.com"
-			apiVersion = "v1alpha1"
-			kind       = "Hello"
-			resource   = "hellos"
-		)
-		var (
-			gk  = schema.GroupKind{Group: groupName, Kind: kind}
-			gvr = schema.GroupVersionResource{Group: groupName, Version: apiVersion, Resource: resource}
-		)
-		populator_machinery.RunController(masterURL, kubeconfig, imageName, httpEndpoint, metricsPath,
-			namespace, prefix, gk, gvr, mountPath, devicePath, getPopulatorPodArgs)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigCh := make(chan os.Signal, 2)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			cancel()
+			<-sigCh
+			os.Exit(1) // second signal. Exit directly.
+		}()
+
+		if err := populator_machinery.Run(ctx, cfg); err != nil {
+			klog.Fatalf("Failed to run controller: %v", err)
+		}
 	case "populate":
 		populate(fileName, fileContents)
+	case "render":
+		render(cfg, pvcFile, scFile, sourceFile)
 	default:
 		klog.Fatalf("Invalid mode: %s", mode)
 	}
 }
 
+func splitKeys(keys string) []string {
+	if keys == "" {
+		return nil
+	}
+	return strings.Split(keys, ",")
+}
+
 func populate(fileName, fileContents string) {
 	if "" == fileName || "" == fileContents {
 		klog.Fatalf("Missing required arg")
@@ -116,6 +231,62 @@ func populate(fileName, fileContents string) {
 	}
 }
 
+// render prints the populator pod and PVC' the controller would create for
+// a PVC, e.g. to compare them with golden files in CI.
+func render(cfg populator_machinery.VolumePopulatorConfig, pvcFile, scFile, sourceFile string) {
+	if "" == pvcFile || "" == sourceFile {
+		klog.Fatalf("Missing required arg")
+	}
+	var pvc corev1.PersistentVolumeClaim
+	err := json.Unmarshal(readYAML(pvcFile), &pvc)
+	if nil != err {
+		klog.Fatalf("Failed to decode PVC: %v", err)
+	}
+	var sc *storagev1.StorageClass
+	if "" != scFile {
+		sc = &storagev1.StorageClass{}
+		err = json.Unmarshal(readYAML(scFile), sc)
+		if nil != err {
+			klog.Fatalf("Failed to decode StorageClass: %v", err)
+		}
+	}
+	var source unstructured.Unstructured
+	err = source.UnmarshalJSON(readYAML(sourceFile))
+	if nil != err {
+		klog.Fatalf("Failed to decode data source: %v", err)
+	}
+
+	objects, err := populator_machinery.Render(cfg, &pvc, sc, &source)
+	if nil != err {
+		klog.Fatalf("Failed to render: %v", err)
+	}
+	if nil != objects.Pod {
+		writeObject(objects.Pod)
+		fmt.Println("---")
+	}
+	writeObject(objects.PvcPrime)
+}
+
+func readYAML(fileName string) []byte {
+	data, err := os.ReadFile(fileName)
+	if nil != err {
+		klog.Fatalf("Failed to read file: %v", err)
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if nil != err {
+		klog.Fatalf("Failed to parse %s: %v", fileName, err)
+	}
+	return data
+}
+
+func writeObject(obj interface{}) {
+	data, err := yaml.Marshal(obj)
+	if nil != err {
+		klog.Fatalf("Failed to encode object: %v", err)
+	}
+	os.Stdout.Write(data)
+}
+
 type Hello struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
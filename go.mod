@@ -3,6 +3,7 @@ module github.com/kubernetes-csi/lib-volume-populator
 go 1.20
 
 require (
+	github.com/google/uuid v1.3.0
 	github.com/prometheus/client_model v0.4.0
 	github.com/prometheus/common v0.44.0
 	k8s.io/api v0.28.0
@@ -12,6 +13,7 @@ require (
 	k8s.io/component-helpers v0.28.0
 	k8s.io/klog/v2 v2.100.1
 	sigs.k8s.io/gateway-api v0.7.1
+	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
@@ -31,7 +33,6 @@ require (
 	github.com/google/gnostic-models v0.6.8 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/google/gofuzz v1.2.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/imdario/mergo v0.3.13 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
@@ -59,5 +60,4 @@ require (
 	k8s.io/utils v0.0.0-20230406110748-d93618cff8a2 // indirect
 	sigs.k8s.io/json v0.0.0-20221116044647-bc3834ca7abd // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.2.3 // indirect
-	sigs.k8s.io/yaml v1.3.0 // indirect
 )
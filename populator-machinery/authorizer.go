@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// authorizationRecheckInterval is how often PVCs denied by a custom
+	// Authorizer are checked again. The controller can't watch whatever
+	// such an authorizer bases its decisions on.
+	authorizationRecheckInterval = time.Minute
+
+	reasonNotAuthorized = "PopulatorNotAuthorized"
+)
+
+// Authorizer decides whether a PVC may use a data source in another
+// namespace than its own. It is called on every sync of such a PVC, before
+// population starts and while it is in progress.
+type Authorizer interface {
+	// Authorize returns true if the PVC may use the data source in
+	// pvc.Spec.DataSourceRef. When it returns false, reason explains why
+	// and is reported in an event on the PVC. An error means no decision
+	// could be made, and the PVC is retried with backoff.
+	Authorize(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (allowed bool, reason string, err error)
+}
+
+// AuthorizerFunc is an adapter to use an ordinary function as an Authorizer.
+type AuthorizerFunc func(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, string, error)
+
+// Authorize calls f(ctx, pvc).
+func (f AuthorizerFunc) Authorize(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, string, error) {
+	return f(ctx, pvc)
+}
+
+// StaticAuthorizer is an Authorizer that returns the same decision for every
+// PVC. The decision can be changed at any time, for example by tests or to
+// allow data sources in other namespaces without any checks.
+type StaticAuthorizer struct {
+	mu      sync.Mutex
+	allowed bool
+	reason  string
+	err     error
+	calls   int
+}
+
+// NewStaticAuthorizer returns a StaticAuthorizer with the given decision.
+func NewStaticAuthorizer(allowed bool, reason string) *StaticAuthorizer {
+	return &StaticAuthorizer{allowed: allowed, reason: reason}
+}
+
+// SetDecision changes the result of all following Authorize calls.
+func (a *StaticAuthorizer) SetDecision(allowed bool, reason string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowed, a.reason, a.err = allowed, reason, err
+}
+
+// Authorize returns the current decision.
+func (a *StaticAuthorizer) Authorize(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	return a.allowed, a.reason, a.err
+}
+
+// Calls returns how often Authorize was called.
+func (a *StaticAuthorizer) Calls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls
+}
+
+// errReferenceGrantsUnsupported is returned by the ReferenceGrant authorizer
+// while the ReferenceGrant API is not installed.
+var errReferenceGrantsUnsupported = errors.New("the ReferenceGrant API is not installed")
+
+// referenceGrantAuthorizer is the default Authorizer. It allows a PVC to use
+// a data source if a Gateway API ReferenceGrant in the data source namespace
+// allows it, see IsGranted.
+type referenceGrantAuthorizer struct {
+	c *controller
+}
+
+func (a *referenceGrantAuthorizer) Authorize(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, string, error) {
+	if !a.c.referenceGrantsEnabled() {
+		return false, "", errReferenceGrantsUnsupported
+	}
+	namespace := *pvc.Spec.DataSourceRef.Namespace
+	// Get all ReferenceGrants in data source's namespace
+	referenceGrants, err := a.c.listReferenceGrants(namespace)
+	if err != nil {
+		return false, "", fmt.Errorf("error getting ReferenceGrants in %s namespace from api server: %v", namespace, err)
+	}
+	if allowed, err := IsGranted(ctx, pvc, referenceGrants); !allowed {
+		return false, err.Error(), nil
+	}
+	return true, "", nil
+}
+
+// usesReferenceGrants returns true if data sources in other namespaces are
+// authorized with ReferenceGrants.
+func (c *controller) usesReferenceGrants() bool {
+	_, ok := c.authorizer.(*referenceGrantAuthorizer)
+	return ok
+}
+
+// authorize checks whether a PVC may use its data source in another
+// namespace. It returns false if the PVC has to wait, together with the
+// result to return from syncPvc.
+func (c *controller) authorize(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	dataSourceRef := pvc.Spec.DataSourceRef
+	allowed, reason, err := c.authorizer.Authorize(ctx, pvc)
+	if err == errReferenceGrantsUnsupported {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonCrossNamespaceUnsupported,
+			"Data source %s/%s is in another namespace, which needs the ReferenceGrant API to be installed", *dataSourceRef.Namespace, dataSourceRef.Name)
+		// We'll get called again if the ReferenceGrant API shows up
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to authorize data source %s/%s: %v", *dataSourceRef.Namespace, dataSourceRef.Name, err)
+	}
+	if !allowed {
+		return false, c.waitForAuthorization(ctx, key, pvc, reason)
+	}
+	return true, nil
+}
+
+// waitForAuthorization is called when a PVC is not allowed to use its data
+// source. Population that already started is cancelled, because the
+// permission may have been revoked. With ReferenceGrants we'll get called
+// again when a ReferenceGrant in the data source namespace changes, other
+// authorizers are asked again periodically.
+func (c *controller) waitForAuthorization(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim, reason string) error {
+	if c.usesReferenceGrants() {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonWaitingForReferenceGrant,
+			"Waiting for a ReferenceGrant in namespace %s: %s", *pvc.Spec.DataSourceRef.Namespace, reason)
+	} else {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonNotAuthorized,
+			"Data source %s/%s is not authorized: %s", *pvc.Spec.DataSourceRef.Namespace, pvc.Spec.DataSourceRef.Name, reason)
+		c.workqueue.AddAfter(key, authorizationRecheckInterval)
+	}
+	if pvc.Spec.VolumeName != "" {
+		// The volume has been populated already
+		return nil
+	}
+	return c.cancelPopulation(ctx, pvc)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSyncPvcAuthorizer(t *testing.T) {
+	tests := []struct {
+		name             string
+		authorizer       *StaticAuthorizer
+		dataSourceNs     string
+		expectCalls      int
+		expectErr        bool
+		expectDenied     bool
+		expectPodDeleted bool
+	}{
+		{
+			name:         "Same namespace is not authorized",
+			authorizer:   NewStaticAuthorizer(false, ""),
+			dataSourceNs: testPvcNamespace,
+		},
+		{
+			name:         "Allowed",
+			authorizer:   NewStaticAuthorizer(true, ""),
+			dataSourceNs: testDataSourceNamespace,
+			expectCalls:  1,
+		},
+		{
+			name:             "Denied",
+			authorizer:       NewStaticAuthorizer(false, "namespace not in allowlist"),
+			dataSourceNs:     testDataSourceNamespace,
+			expectCalls:      1,
+			expectDenied:     true,
+			expectPodDeleted: true,
+		},
+		{
+			name: "No decision",
+			authorizer: func() *StaticAuthorizer {
+				a := NewStaticAuthorizer(false, "")
+				a.SetDecision(false, "", fmt.Errorf("access review failed"))
+				return a
+			}(),
+			dataSourceNs: testDataSourceNamespace,
+			expectCalls:  1,
+			expectErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := populatingPvc()
+			claim.Spec.DataSourceRef = dsf(testApiGroup, testDatasourceKind, testDataSourceName, test.dataSourceNs)
+			source := ust()
+			source.SetNamespace(test.dataSourceNs)
+			c, recorder := initSyncTest(t, claim, pod(corev1.PodRunning), source, sc())
+			c.authorizer = test.authorizer
+			// ReferenceGrants must not matter with another authorizer
+			c.referenceGrantsFound = 0
+
+			err := syncTestPvc(c)
+			if (err != nil) != test.expectErr {
+				t.Errorf("Expected error %t, got %v", test.expectErr, err)
+			}
+			if calls := test.authorizer.Calls(); calls != test.expectCalls {
+				t.Errorf("Expected %d authorizer calls, got %d", test.expectCalls, calls)
+			}
+			expectEvents := 0
+			if test.expectDenied {
+				expectEvents = 1
+			}
+			if n := countEvents(recorder, reasonNotAuthorized); n != expectEvents {
+				t.Errorf("Expected %d %s events, got %d", expectEvents, reasonNotAuthorized, n)
+			}
+			_, err = c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if (err != nil) != test.expectPodDeleted {
+				t.Errorf("Expected pod deleted %t, got error %v", test.expectPodDeleted, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizerFunc(t *testing.T) {
+	var got *corev1.PersistentVolumeClaim
+	authorizer := AuthorizerFunc(func(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, string, error) {
+		got = pvc
+		return pvc.Namespace == testPvcNamespace, "wrong namespace", nil
+	})
+	claim := pvc(testPvcName, testPvcNamespace, "", "", "", dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+	allowed, _, err := authorizer.Authorize(context.TODO(), claim)
+	if err != nil || !allowed {
+		t.Errorf("Expected allowed, got %t, %v", allowed, err)
+	}
+	if got != claim {
+		t.Errorf("Expected the function to be called with the PVC")
+	}
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	authorizer := NewStaticAuthorizer(false, "not yet")
+	claim := pvc(testPvcName, testPvcNamespace, "", "", "", dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+
+	allowed, reason, err := authorizer.Authorize(context.TODO(), claim)
+	if err != nil || allowed || reason != "not yet" {
+		t.Errorf("Expected denied with reason, got %t, %q, %v", allowed, reason, err)
+	}
+
+	authorizer.SetDecision(true, "", nil)
+	allowed, _, err = authorizer.Authorize(context.TODO(), claim)
+	if err != nil || !allowed {
+		t.Errorf("Expected allowed, got %t, %v", allowed, err)
+	}
+	if calls := authorizer.Calls(); calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+}
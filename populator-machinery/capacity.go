@@ -0,0 +1,247 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	requiredSizeAnnoSuffix = "required-size"
+
+	reasonInsufficientCapacity = "PopulatorInsufficientCapacity"
+	reasonPopulatorResizing    = "PopulatorResizing"
+)
+
+// ReportRequiredSize is called from inside a populator pod when the data does
+// not fit into the volume, ideally before writing anything. It annotates the
+// pod with the minimum volume size, and the populator should exit afterwards.
+// The report counts even if the populator exits successfully, unless the
+// volume is big enough already. If the StorageClass allows volume expansion, the controller expands PVC' and
+// starts a new populator pod. Otherwise population fails with an event that
+// tells the user the minimum size. prefix must be the same prefix the
+// controller was started with. The pod's service account needs permission to
+// patch pods in the populator namespace.
+func ReportRequiredSize(ctx context.Context, kubeClient kubernetes.Interface, prefix string, size resource.Quantity) error {
+	name, namespace := os.Getenv(podNameEnv), os.Getenv(podNamespaceEnv)
+	if name == "" || namespace == "" {
+		return fmt.Errorf("%s and %s must be set to report the required size", podNameEnv, podNamespaceEnv)
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				prefix + "/" + requiredSizeAnnoSuffix: size.String(),
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// RequiredSizeError is returned by the provider functions when the data does
+// not fit into the volume of PvcPrime. It is handled like a size reported with
+// ReportRequiredSize.
+type RequiredSizeError struct {
+	// Size is the minimum size of the volume.
+	Size resource.Quantity
+}
+
+func (e *RequiredSizeError) Error() string {
+	return fmt.Sprintf("the volume must be at least %s", e.Size.String())
+}
+
+// requiredSizeFromError returns the size in a RequiredSizeError returned by a
+// provider function, if any.
+func requiredSizeFromError(err error) (resource.Quantity, bool) {
+	var sizeErr *RequiredSizeError
+	if !stderrors.As(err, &sizeErr) {
+		return resource.Quantity{}, false
+	}
+	return sizeErr.Size, true
+}
+
+// reportedSize returns the size a populator pod reported with
+// ReportRequiredSize, if any.
+func (c *controller) reportedSize(pod *corev1.Pod) (resource.Quantity, bool) {
+	value, ok := pod.Annotations[c.requiredSizeAnno]
+	if !ok {
+		return resource.Quantity{}, false
+	}
+	size, err := resource.ParseQuantity(value)
+	if err != nil {
+		klog.V(2).Infof("Ignoring invalid required size %q of pod %s/%s: %v", value, pod.Namespace, pod.Name, err)
+		return resource.Quantity{}, false
+	}
+	return size, true
+}
+
+// pvcPrimeResources returns the resources of PVC': those of the PVC, with the
+// storage request raised to the size the populator needs, if known.
+func (c *controller) pvcPrimeResources(pvc *corev1.PersistentVolumeClaim) corev1.ResourceRequirements {
+	resources := *pvc.Spec.Resources.DeepCopy()
+	value, ok := pvc.Annotations[c.requiredSizeAnno]
+	if !ok {
+		return resources
+	}
+	size, err := resource.ParseQuantity(value)
+	if err != nil {
+		return resources
+	}
+	if request, ok := resources.Requests[corev1.ResourceStorage]; !ok || size.Cmp(request) > 0 {
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[corev1.ResourceStorage] = size
+	}
+	return resources
+}
+
+// handleRequiredSize is called when the populator reports that the volume
+// must be at least size. If the StorageClass allows volume expansion, PVC' is
+// expanded, or deleted if it isn't bound yet, and population starts over.
+// Otherwise population fails. It returns false if PVC' is big enough already,
+// in which case the report is treated like any other failure.
+func (c *controller) handleRequiredSize(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim,
+	ds *dataSource, source *unstructured.Unstructured, pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim,
+	size resource.Quantity, allowExpansion bool,
+) (bool, error) {
+	if pod != nil && pod.DeletionTimestamp != nil {
+		// We handled this report already
+		return true, nil
+	}
+
+	if pvcPrime != nil {
+		current := pvcPrime.Spec.Resources.Requests[corev1.ResourceStorage]
+		if size.Cmp(current) <= 0 {
+			capacity := pvcPrime.Status.Capacity[corev1.ResourceStorage]
+			if pvcPrime.Spec.VolumeName != "" && size.Cmp(capacity) <= 0 {
+				// The volume is big enough, so the populator failed for
+				// another reason
+				return false, nil
+			}
+			// PVC' was expanded, but the populator ran before the volume
+			// was. Try again.
+			return true, c.deletePopulatorPod(ctx, pod)
+		}
+	}
+
+	request := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if !allowExpansion {
+		message := fmt.Sprintf("the data source needs a volume of at least %s, but %s was requested", size.String(), request.String())
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonInsufficientCapacity,
+			"Populator needs a volume of at least %s, but %s was requested. Recreate the PVC requesting at least %s, or use a StorageClass that allows volume expansion",
+			size.String(), request.String(), size.String())
+		state := c.getRetryState(pvc)
+		state.lastFailure = time.Now()
+		state.message = message
+		err := c.abandonPopulation(ctx, key, pvc, pod, pvcPrime, state)
+		if err != nil {
+			return true, err
+		}
+		c.updateDataSourceStatus(ctx, ds, source, pvc, populationFailed, message)
+		return true, nil
+	}
+
+	c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPopulatorResizing,
+		"Populator needs a volume of at least %s, %s was requested. Expanding the volume", size.String(), request.String())
+	// Remember the size for when PVC' has to be created again
+	err := c.setRequiredSize(ctx, pvc, size)
+	if err != nil {
+		return true, err
+	}
+	if pvcPrime != nil {
+		if pvcPrime.Spec.VolumeName != "" {
+			err = c.expandPvcPrime(ctx, pvcPrime, size)
+		} else {
+			// Unbound PVCs can't be expanded, so make a new one
+			err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvcPrime.Namespace).Delete(ctx, pvcPrime.Name, metav1.DeleteOptions{})
+			if errors.IsNotFound(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	// We'll get called again later when the pod is gone
+	return true, c.deletePopulatorPod(ctx, pod)
+}
+
+func (c *controller) setRequiredSize(ctx context.Context, pvc *corev1.PersistentVolumeClaim, size resource.Quantity) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				c.requiredSizeAnno: size.String(),
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
+
+func (c *controller) expandPvcPrime(ctx context.Context, pvcPrime *corev1.PersistentVolumeClaim, size resource.Quantity) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]string{
+					string(corev1.ResourceStorage): size.String(),
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvcPrime.Namespace).Patch(ctx, pvcPrime.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
+
+func (c *controller) deletePopulatorPod(ctx context.Context, pod *corev1.Pod) error {
+	if pod == nil {
+		return nil
+	}
+	err := c.kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
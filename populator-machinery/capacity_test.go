@@ -0,0 +1,242 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReportRequiredSize(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(pod(corev1.PodRunning))
+	requiredSizeAnno := testPrefix + "/" + requiredSizeAnnoSuffix
+
+	if err := ReportRequiredSize(context.TODO(), kubeClient, testPrefix, resource.MustParse("2Gi")); err == nil {
+		t.Errorf("Expected error without pod name and namespace")
+	}
+
+	t.Setenv(podNameEnv, testPodName)
+	t.Setenv(podNamespaceEnv, testVpWorkingNamespace)
+	if err := ReportRequiredSize(context.TODO(), kubeClient, testPrefix, resource.MustParse("2Gi")); err != nil {
+		t.Fatalf("Failed to report required size: %v", err)
+	}
+
+	got, err := kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pod failed: %v", err)
+	}
+	if value := got.Annotations[requiredSizeAnno]; value != "2Gi" {
+		t.Errorf("Expected required size annotation 2Gi, got %s", value)
+	}
+}
+
+func TestPvcPrimeResources(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+
+	tests := []struct {
+		name     string
+		request  string
+		required string
+		expected string
+	}{
+		{
+			name:     "Nothing required",
+			request:  "1Gi",
+			expected: "1Gi",
+		},
+		{
+			name:     "More required",
+			request:  "1Gi",
+			required: "2Gi",
+			expected: "2Gi",
+		},
+		{
+			name:     "Less required",
+			request:  "3Gi",
+			required: "2Gi",
+			expected: "3Gi",
+		},
+		{
+			name:     "Invalid required size",
+			request:  "1Gi",
+			required: "lots",
+			expected: "1Gi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", nil, "")
+			claim.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(test.request)}
+			if test.required != "" {
+				claim.Annotations[c.requiredSizeAnno] = test.required
+			}
+			resources := c.pvcPrimeResources(claim)
+			got := resources.Requests[corev1.ResourceStorage]
+			if got.Cmp(resource.MustParse(test.expected)) != 0 {
+				t.Errorf("Expected %s, got %s", test.expected, got.String())
+			}
+			if request := claim.Spec.Resources.Requests[corev1.ResourceStorage]; request.Cmp(resource.MustParse(test.request)) != 0 {
+				t.Errorf("PVC request was modified to %s", request.String())
+			}
+		})
+	}
+}
+
+func TestSyncPvcRequiredSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowExpansion bool
+		pvcPrimeVolume string
+		pvcPrimeSize   string
+		podPhase       corev1.PodPhase
+		expectReason   string
+		expectPvcPrime string
+		expectFailed   bool
+	}{
+		{
+			name:           "Expand bound PVC'",
+			allowExpansion: true,
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodFailed,
+			expectReason:   reasonPopulatorResizing,
+			expectPvcPrime: "2Gi",
+		},
+		{
+			name:           "Expand before writing",
+			allowExpansion: true,
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodRunning,
+			expectReason:   reasonPopulatorResizing,
+			expectPvcPrime: "2Gi",
+		},
+		{
+			name:           "Expand after the populator succeeded",
+			allowExpansion: true,
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodSucceeded,
+			expectReason:   reasonPopulatorResizing,
+			expectPvcPrime: "2Gi",
+		},
+		{
+			name:           "Recreate unbound PVC'",
+			allowExpansion: true,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodFailed,
+			expectReason:   reasonPopulatorResizing,
+		},
+		{
+			name:           "No expansion",
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodFailed,
+			expectReason:   reasonInsufficientCapacity,
+			expectFailed:   true,
+		},
+		{
+			name:           "No expansion after the populator succeeded",
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "1Gi",
+			podPhase:       corev1.PodSucceeded,
+			expectReason:   reasonInsufficientCapacity,
+			expectFailed:   true,
+		},
+		{
+			name:           "PVC' big enough",
+			allowExpansion: true,
+			pvcPrimeVolume: testPvName,
+			pvcPrimeSize:   "2Gi",
+			podPhase:       corev1.PodFailed,
+			expectReason:   reasonPodFailed,
+			expectPvcPrime: "2Gi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := populatingPvc()
+			claim.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}
+			pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, test.pvcPrimeVolume, nil, "")
+			size := resource.MustParse(test.pvcPrimeSize)
+			pvcPrime.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: size}
+			if test.pvcPrimeVolume != "" {
+				pvcPrime.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: size}
+			}
+			p := pod(test.podPhase)
+			p.Annotations = map[string]string{testPrefix + "/" + requiredSizeAnnoSuffix: "2Gi"}
+			storageClass := sc()
+			storageClass.AllowVolumeExpansion = &test.allowExpansion
+			c, recorder := initSyncTest(t, claim, pvcPrime, p, ust(), storageClass)
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if n := countEvents(recorder, test.expectReason); n != 1 {
+				t.Errorf("Expected one %s event, got %d", test.expectReason, n)
+			}
+			_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if err == nil {
+				t.Errorf("Expected pod to be deleted")
+			}
+			gotPrime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if test.expectPvcPrime == "" {
+				if err == nil {
+					t.Errorf("Expected PVC' to be deleted")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Get PVC' failed: %v", err)
+				}
+				request := gotPrime.Spec.Resources.Requests[corev1.ResourceStorage]
+				if request.Cmp(resource.MustParse(test.expectPvcPrime)) != 0 {
+					t.Errorf("Expected PVC' request %s, got %s", test.expectPvcPrime, request.String())
+				}
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if _, failed := got.Annotations[c.failedAnno]; failed != test.expectFailed {
+				t.Errorf("Expected failed %t, got annotations %v", test.expectFailed, got.Annotations)
+			}
+			if test.allowExpansion && test.expectReason == reasonPopulatorResizing && got.Annotations[c.requiredSizeAnno] != "2Gi" {
+				t.Errorf("Expected required size to be recorded, got annotations %v", got.Annotations)
+			}
+		})
+	}
+}
+
+func TestRequiredSizeFromError(t *testing.T) {
+	err := fmt.Errorf("populate failed: %w", &RequiredSizeError{Size: resource.MustParse("5Gi")})
+	size, ok := requiredSizeFromError(err)
+	if !ok || size.Cmp(resource.MustParse("5Gi")) != 0 {
+		t.Errorf("Expected 5Gi, got %s, %t", size.String(), ok)
+	}
+	if _, ok := requiredSizeFromError(fmt.Errorf("other failure")); ok {
+		t.Errorf("Expected no size for other errors")
+	}
+}
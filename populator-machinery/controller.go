@@ -23,6 +23,7 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -31,7 +32,6 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/json"
@@ -46,15 +46,14 @@ import (
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/component-helpers/storage/volume"
 	"k8s.io/klog/v2"
-	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
-	gatewayInformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
-	referenceGrantv1beta1 "sigs.k8s.io/gateway-api/pkg/client/listers/apis/v1beta1"
 )
 
 const (
@@ -66,12 +65,16 @@ const (
 	pvcFinalizerSuffix      = "populate-target-protection"
 	annSelectedNode         = "volume.kubernetes.io/selected-node"
 	controllerNameSuffix    = "populator"
+	defaultWorkers          = 1
 
 	reasonPodCreationError   = "PopulatorCreationError"
 	reasonPodCreationSuccess = "PopulatorCreated"
 	reasonPodFailed          = "PopulatorFailed"
 	reasonPodFinished        = "PopulatorFinished"
 	reasonPVCCreationError   = "PopulatorPVCCreationError"
+	reasonRetriesExhausted   = "PopulatorRetriesExhausted"
+	reasonPopulatorProgress  = "PopulatorProgress"
+	reasonPopulatorCancelled = "PopulatorCancelled"
 )
 
 type empty struct{}
@@ -81,14 +84,31 @@ type stringSet struct {
 }
 
 type controller struct {
+	prefix               string
 	populatorNamespace   string
 	populatedFromAnno    string
+	sourceKindAnno       string
+	sourceUIDAnno        string
+	sourceVersionAnno    string
+	sourceGenAnno        string
+	imageAnno            string
+	populatedAtAnno      string
 	pvcFinalizer         string
+	attemptsAnno         string
+	lastFailureAnno      string
+	failedAttemptAnno    string
+	failedAnno           string
+	progressAnno         string
+	failureAnno          string
+	requiredSizeAnno     string
+	timeoutAnno          string
+	completeAnno         string
 	kubeClient           kubernetes.Interface
-	imageName            string
+	dynClient            dynamic.Interface
 	devicePath           string
 	mountPath            string
 	pvcLister            corelisters.PersistentVolumeClaimLister
+	pvcIndexer           cache.Indexer
 	pvcSynced            cache.InformerSynced
 	pvLister             corelisters.PersistentVolumeLister
 	pvSynced             cache.InformerSynced
@@ -96,54 +116,298 @@ type controller struct {
 	podSynced            cache.InformerSynced
 	scLister             storagelisters.StorageClassLister
 	scSynced             cache.InformerSynced
-	unstLister           dynamiclister.Lister
-	unstSynced           cache.InformerSynced
 	mu                   sync.Mutex
 	notifyMap            map[string]*stringSet
 	cleanupMap           map[string]*stringSet
 	workqueue            workqueue.RateLimitingInterface
-	populatorArgs        func(bool, *unstructured.Unstructured) ([]string, error)
-	gk                   schema.GroupKind
+	workers              int
+	workersWg            sync.WaitGroup
+	workerTracker        *workerTracker
+	workerStallTimeout   time.Duration
+	started              int32
+	podMutator           func(*corev1.Pod, *corev1.PersistentVolumeClaim, *unstructured.Unstructured) error
+	pvcPrime             PvcPrimeConfig
+	sweeper              OrphanSweeperConfig
+	retryPolicy          RetryPolicy
+	retryPolicyOverride  func(*unstructured.Unstructured) *RetryPolicy
+	populationTimeout    time.Duration
+	failureLogLines      int64
+	dataSources          map[schema.GroupKind]*dataSource
+	dataSourceStatus     bool
+	sourceChangePolicy   DataSourceChangePolicy
 	metrics              *metricsManager
 	recorder             record.EventRecorder
-	referenceGrantLister referenceGrantv1beta1.ReferenceGrantLister
+	referenceGrantLister dynamiclister.Lister
 	referenceGrantSynced cache.InformerSynced
+	referenceGrantsFound int32
+	authorizer           Authorizer
 }
 
+// VolumePopulatorConfig holds the settings for a populator controller started
+// with Run.
+type VolumePopulatorConfig struct {
+	// MasterURL is the address of the Kubernetes API server. Only required if
+	// out-of-cluster.
+	MasterURL string
+	// Kubeconfig is the path to a kubeconfig. Only required if out-of-cluster.
+	Kubeconfig string
+	// RestConfig, if set, is used to create the clients instead of
+	// MasterURL and Kubeconfig.
+	RestConfig *rest.Config
+	// ImageName is the image used for the populator pods. Not used with
+	// ProviderFunctionConfig.
+	ImageName string
+	// HttpEndpoint is the TCP network address where the HTTP server for
+	// diagnostics will listen. Empty disables the server.
+	HttpEndpoint string
+	// MetricsPath is the HTTP path where prometheus metrics are exposed.
+	// Empty disables the metrics, but not the health checks of the
+	// diagnostics server.
+	MetricsPath string
+	// Namespace is the working namespace of the populator, where the
+	// populator pods and PVC' objects are created.
+	Namespace string
+	// Prefix is used for the annotation, finalizer and event source names.
+	Prefix string
+	// Gk is the group and kind of the data source handled by this populator.
+	// It can be left empty if DataSources is set.
+	Gk schema.GroupKind
+	// Gvr is the group, version and resource of the data source.
+	Gvr schema.GroupVersionResource
+	// DataSources are further data source kinds served by the same
+	// controller, each with its own image and populator args. They share
+	// the informers, workqueue and workers.
+	DataSources []DataSourceConfig
+	// DataSourceStatus writes the state of the populations to the status
+	// subresource of the data sources and records events on them. The data
+	// source CRDs need a status subresource and the controller permission to
+	// update it.
+	DataSourceStatus bool
+	// DataSourceChangePolicy defines what happens when a data source is
+	// changed or deleted while a PVC is populated from it. Defaults to
+	// DataSourceChangePin.
+	DataSourceChangePolicy DataSourceChangePolicy
+	// Authorizer, if set, decides whether PVCs may use data sources in
+	// other namespaces. By default a Gateway API ReferenceGrant in the data
+	// source namespace has to allow it, and the controller watches
+	// ReferenceGrants.
+	Authorizer Authorizer
+	// MountPath is where the volume is mounted in the populator pod for
+	// filesystem volumes.
+	MountPath string
+	// DevicePath is where the volume is attached in the populator pod for
+	// block volumes.
+	DevicePath string
+	// PopulatorArgs returns the args for the populator pod, given whether the
+	// volume is raw block and the data source object.
+	PopulatorArgs func(bool, *unstructured.Unstructured) ([]string, error)
+	// ProviderFunctionConfig, if set, populates volumes in process with the
+	// given functions instead of running populator pods. ImageName,
+	// PopulatorArgs, PodMutator and RetryPolicy are not used then.
+	ProviderFunctionConfig *ProviderFunctionConfig
+	// PodMutator, if set, is called on every populator pod before it is
+	// created, with the PVC being populated and its data source. It can set
+	// resources, tolerations, node selectors, service account, image pull
+	// secrets and so on, but must not change the pod name or namespace, the
+	// "target" volume or the "populate" container's volume mounts.
+	PodMutator func(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim, dataSource *unstructured.Unstructured) error
+	// PvcPrime controls which labels, annotations and other fields of a PVC
+	// are copied to its PVC'.
+	PvcPrime PvcPrimeConfig
+	// RetryPolicy controls how failed populator pods are retried. By default
+	// they are retried immediately and forever.
+	RetryPolicy RetryPolicy
+	// RetryPolicyOverride, if set, returns the retry policy for a specific
+	// data source. Returning nil uses RetryPolicy.
+	RetryPolicyOverride func(dataSource *unstructured.Unstructured) *RetryPolicy
+	// PopulationTimeout limits how long an attempt to populate a volume may
+	// take, from the creation of the populator pod, or of PVC' with
+	// ProviderFunctionConfig, until the volume is handed over to the PVC.
+	// Populator pods get a matching ActiveDeadlineSeconds. A timed out
+	// attempt is handled like a failed populator pod. Data sources can
+	// override it with the <prefix>/population-timeout annotation, for
+	// example "30m". Zero means no limit.
+	PopulationTimeout time.Duration
+	// FailureLogLines is the number of log lines of a failed populator pod to
+	// include in the failure event and annotation. Zero disables reading logs.
+	FailureLogLines int64
+	// MetricsSourceLabels adds the data source group and kind and the
+	// storage class as labels to the populator metrics.
+	MetricsSourceLabels bool
+	// Workers is the number of PVCs synced concurrently. Defaults to 1.
+	Workers int
+	// WorkerStallTimeout is how long a worker may spend syncing a single PVC
+	// before the /healthz check reports the controller as unhealthy.
+	// Defaults to 5m.
+	WorkerStallTimeout time.Duration
+	// LeaderElection configures leader election between controller replicas.
+	LeaderElection LeaderElectionConfig
+	// OrphanSweeper configures the deletion of populator pods and PVC'
+	// objects left behind by deleted PVCs.
+	OrphanSweeper OrphanSweeperConfig
+}
+
+func (cfg *VolumePopulatorConfig) setDefaults() {
+	if cfg.Workers == 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.WorkerStallTimeout == 0 {
+		cfg.WorkerStallTimeout = defaultWorkerStallTimeout
+	}
+	cfg.RetryPolicy.setDefaults()
+	cfg.OrphanSweeper.setDefaults()
+	if cfg.DataSourceChangePolicy == "" {
+		cfg.DataSourceChangePolicy = DataSourceChangePin
+	}
+	if cfg.ProviderFunctionConfig != nil && cfg.ProviderFunctionConfig.PollInterval == 0 {
+		cfg.ProviderFunctionConfig.PollInterval = defaultProviderPollInterval
+	}
+	for i := range cfg.DataSources {
+		cfg.DataSources[i].setDefaults(cfg.ImageName)
+	}
+	le := &cfg.LeaderElection
+	if le.Namespace == "" {
+		le.Namespace = cfg.Namespace
+	}
+	if le.LeaseName == "" {
+		le.LeaseName = cfg.Prefix + "-" + controllerNameSuffix
+	}
+	if le.LeaseDuration == 0 {
+		le.LeaseDuration = defaultLeaseDuration
+	}
+	if le.RenewDeadline == 0 {
+		le.RenewDeadline = defaultRenewDeadline
+	}
+	if le.RetryPeriod == 0 {
+		le.RetryPeriod = defaultRetryPeriod
+	}
+}
+
+func (cfg *VolumePopulatorConfig) validate() error {
+	if cfg.Namespace == "" {
+		return fmt.Errorf("namespace must be set")
+	}
+	if cfg.Prefix == "" {
+		return fmt.Errorf("prefix must be set")
+	}
+	sources := cfg.dataSourceConfigs()
+	if len(sources) == 0 {
+		return fmt.Errorf("data source kind must be set")
+	}
+	seen := make(map[schema.GroupKind]bool)
+	for _, ds := range sources {
+		if err := ds.validate(); err != nil {
+			return fmt.Errorf("invalid data source %s: %v", ds.Gk, err)
+		}
+		if seen[ds.Gk] {
+			return fmt.Errorf("data source %s is configured more than once", ds.Gk)
+		}
+		seen[ds.Gk] = true
+	}
+	if err := cfg.RetryPolicy.validate(); err != nil {
+		return fmt.Errorf("invalid retry policy: %v", err)
+	}
+	if err := cfg.DataSourceChangePolicy.validate(); err != nil {
+		return err
+	}
+	if err := cfg.PvcPrime.validate(); err != nil {
+		return fmt.Errorf("invalid PVC' config: %v", err)
+	}
+	if err := cfg.OrphanSweeper.validate(); err != nil {
+		return fmt.Errorf("invalid orphan sweeper config: %v", err)
+	}
+	if cfg.PopulationTimeout < 0 {
+		return fmt.Errorf("population timeout must not be negative")
+	}
+	if cfg.FailureLogLines < 0 {
+		return fmt.Errorf("failure log lines must not be negative")
+	}
+	if cfg.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if le := cfg.LeaderElection; le.Enabled {
+		if le.LeaseDuration <= le.RenewDeadline {
+			return fmt.Errorf("leader election lease duration must be greater than the renew deadline")
+		}
+		if le.RenewDeadline <= le.RetryPeriod {
+			return fmt.Errorf("leader election renew deadline must be greater than the retry period")
+		}
+	}
+	return nil
+}
+
+// RunController runs the populator controller until SIGINT or SIGTERM is
+// received. It is kept for compatibility; new callers should use Run.
 func RunController(masterURL, kubeconfig, imageName, httpEndpoint, metricsPath, namespace, prefix string,
 	gk schema.GroupKind, gvr schema.GroupVersionResource, mountPath, devicePath string,
 	populatorArgs func(bool, *unstructured.Unstructured) ([]string, error),
 ) {
-	klog.Infof("Starting populator controller for %s", gk)
-
-	stopCh := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	sigCh := make(chan os.Signal, 2)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigCh
-		close(stopCh)
+		cancel()
 		<-sigCh
 		os.Exit(1) // second signal. Exit directly.
 	}()
 
-	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
-	if err != nil {
-		klog.Fatalf("Failed to create config: %v", err)
+	cfg := VolumePopulatorConfig{
+		MasterURL:     masterURL,
+		Kubeconfig:    kubeconfig,
+		ImageName:     imageName,
+		HttpEndpoint:  httpEndpoint,
+		MetricsPath:   metricsPath,
+		Namespace:     namespace,
+		Prefix:        prefix,
+		Gk:            gk,
+		Gvr:           gvr,
+		MountPath:     mountPath,
+		DevicePath:    devicePath,
+		PopulatorArgs: populatorArgs,
+	}
+	if err := Run(ctx, cfg); err != nil {
+		klog.Fatalf("Failed to run controller: %v", err)
 	}
+}
 
-	kubeClient, err := kubernetes.NewForConfig(cfg)
-	if err != nil {
-		klog.Fatalf("Failed to create client: %v", err)
+// Run validates cfg and runs the populator controller until ctx is cancelled.
+// Setup failures and failures of the diagnostics server are returned instead
+// of exiting the process. Once ctx is cancelled, Run stops the workers,
+// informers and diagnostics server and returns after they have shut down. Run
+// does not handle any signals; callers that want to stop on SIGTERM should
+// cancel ctx themselves.
+func Run(ctx context.Context, cfg VolumePopulatorConfig) error {
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid populator config: %v", err)
+	}
+
+	sources := cfg.dataSourceConfigs()
+	kinds := make([]string, 0, len(sources))
+	for _, ds := range sources {
+		kinds = append(kinds, ds.Gk.String())
+	}
+	klog.Infof("Starting populator controller for %s", strings.Join(kinds, ", "))
+
+	kubeCfg := cfg.RestConfig
+	if kubeCfg == nil {
+		var err error
+		kubeCfg, err = clientcmd.BuildConfigFromFlags(cfg.MasterURL, cfg.Kubeconfig)
+		if err != nil {
+			return fmt.Errorf("failed to create config: %v", err)
+		}
 	}
 
-	dynClient, err := dynamic.NewForConfig(cfg)
+	kubeClient, err := kubernetes.NewForConfig(kubeCfg)
 	if err != nil {
-		klog.Fatalf("Failed to create dynamic client: %v", err)
+		return fmt.Errorf("failed to create client: %v", err)
 	}
 
-	gatewayClient, err := gatewayclientset.NewForConfig(cfg)
+	dynClient, err := dynamic.NewForConfig(kubeCfg)
 	if err != nil {
-		klog.Fatalf("Failed to create gateway client: %v", err)
+		return fmt.Errorf("failed to create dynamic client: %v", err)
 	}
 
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
@@ -153,43 +417,75 @@ func RunController(masterURL, kubeconfig, imageName, httpEndpoint, metricsPath,
 	pvInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	scInformer := kubeInformerFactory.Storage().V1().StorageClasses()
-	unstInformer := dynInformerFactory.ForResource(gvr).Informer()
-
-	gatewayInformerFactory := gatewayInformers.NewSharedInformerFactory(gatewayClient, time.Second*30)
-	referenceGrants := gatewayInformerFactory.Gateway().V1beta1().ReferenceGrants()
-
-	c := &controller{
-		kubeClient:           kubeClient,
-		imageName:            imageName,
-		populatorNamespace:   namespace,
-		devicePath:           devicePath,
-		mountPath:            mountPath,
-		populatedFromAnno:    prefix + "/" + populatedFromAnnoSuffix,
-		pvcFinalizer:         prefix + "/" + pvcFinalizerSuffix,
-		pvcLister:            pvcInformer.Lister(),
-		pvcSynced:            pvcInformer.Informer().HasSynced,
-		pvLister:             pvInformer.Lister(),
-		pvSynced:             pvInformer.Informer().HasSynced,
-		podLister:            podInformer.Lister(),
-		podSynced:            podInformer.Informer().HasSynced,
-		scLister:             scInformer.Lister(),
-		scSynced:             scInformer.Informer().HasSynced,
-		unstLister:           dynamiclister.New(unstInformer.GetIndexer(), gvr),
-		unstSynced:           unstInformer.HasSynced,
-		notifyMap:            make(map[string]*stringSet),
-		cleanupMap:           make(map[string]*stringSet),
-		workqueue:            workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		populatorArgs:        populatorArgs,
-		gk:                   gk,
-		metrics:              initMetrics(),
-		recorder:             getRecorder(kubeClient, prefix+"-"+controllerNameSuffix),
-		referenceGrantLister: referenceGrants.Lister(),
-		referenceGrantSynced: referenceGrants.Informer().HasSynced,
-	}
-
-	c.metrics.startListener(httpEndpoint, metricsPath)
+	dataSources := make(map[schema.GroupKind]*dataSource, len(sources))
+	unstInformers := make(map[schema.GroupKind]cache.SharedIndexInformer, len(sources))
+	for _, ds := range sources {
+		unstInformer := dynInformerFactory.ForResource(ds.Gvr).Informer()
+		unstInformers[ds.Gk] = unstInformer
+		dataSources[ds.Gk] = newDataSource(ds)
+		dataSources[ds.Gk].lister = dynamiclister.New(unstInformer.GetIndexer(), ds.Gvr)
+		dataSources[ds.Gk].synced = unstInformer.HasSynced
+	}
+
+	eventBroadcaster := newEventBroadcaster(kubeClient)
+	defer eventBroadcaster.Shutdown()
+
+	c := newController(&cfg, dataSources)
+	c.kubeClient = kubeClient
+	c.dynClient = dynClient
+	c.pvcLister = pvcInformer.Lister()
+	c.pvcIndexer = pvcInformer.Informer().GetIndexer()
+	c.pvcSynced = pvcInformer.Informer().HasSynced
+	c.pvLister = pvInformer.Lister()
+	c.pvSynced = pvInformer.Informer().HasSynced
+	c.podLister = podInformer.Lister()
+	c.podSynced = podInformer.Informer().HasSynced
+	c.scLister = scInformer.Lister()
+	c.scSynced = scInformer.Informer().HasSynced
+	c.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	c.metrics = initMetricsWithSourceLabels(cfg.MetricsSourceLabels)
+	c.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: cfg.Prefix + "-" + controllerNameSuffix})
+	if c.authorizer == nil {
+		c.authorizer = &referenceGrantAuthorizer{c}
+	}
+
+	c.metrics.addHealthCheck(c.livenessCheck())
+	c.metrics.addReadyCheck(c.readinessCheck())
+
+	var watchdog *leaderelection.HealthzAdaptor
+	if cfg.LeaderElection.Enabled {
+		watchdog = leaderelection.NewLeaderHealthzAdaptor(leaderElectionHealthTimeout)
+		c.metrics.addHealthCheck(watchdog)
+	}
+
+	if err := c.metrics.startListener(cfg.HttpEndpoint, cfg.MetricsPath); err != nil {
+		return err
+	}
 	defer c.metrics.stopListener()
 
+	// Stop the controller if the diagnostics server fails, instead of
+	// exiting the process
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var serveErr error
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		select {
+		case serveErr = <-c.metrics.serveErrors():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = pvcInformer.Informer().AddIndexers(cache.Indexers{
+		dataSourceNamespaceIndex: dataSourceNamespaceIndexFunc,
+		pvcUIDIndex:              pvcUIDIndexFunc,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add PVC indexer: %v", err)
+	}
+
 	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: c.handlePVC,
 		UpdateFunc: func(old, new interface{}) {
@@ -242,34 +538,114 @@ func RunController(masterURL, kubeconfig, imageName, httpEndpoint, metricsPath,
 		DeleteFunc: c.handleSC,
 	})
 
-	unstInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: c.handleUnstructured,
-		UpdateFunc: func(old, new interface{}) {
-			newUnstructured := new.(*unstructured.Unstructured)
-			oldUnstructured := old.(*unstructured.Unstructured)
-			if newUnstructured.GetResourceVersion() == oldUnstructured.GetResourceVersion() {
-				return
+	for gk, unstInformer := range unstInformers {
+		handleUnstructured := c.handleUnstructured(gk)
+		unstInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: handleUnstructured,
+			UpdateFunc: func(old, new interface{}) {
+				newUnstructured := new.(*unstructured.Unstructured)
+				oldUnstructured := old.(*unstructured.Unstructured)
+				if newUnstructured.GetResourceVersion() == oldUnstructured.GetResourceVersion() {
+					return
+				}
+				handleUnstructured(new)
+			},
+			DeleteFunc: handleUnstructured,
+		})
+	}
+
+	run := func(ctx context.Context) error {
+		stopCh := ctx.Done()
+		var wg sync.WaitGroup
+		if c.usesReferenceGrants() {
+			c.startReferenceGrants(ctx, kubeClient.Discovery(), dynInformerFactory, &wg)
+		}
+		kubeInformerFactory.Start(stopCh)
+		dynInformerFactory.Start(stopCh)
+		// Wait for the informer goroutines to exit once ctx is cancelled
+		defer kubeInformerFactory.Shutdown()
+		defer dynInformerFactory.Shutdown()
+		// Stop looking for the ReferenceGrant API before that
+		defer wg.Wait()
+
+		if err := c.run(ctx); err != nil {
+			if ctx.Err() != nil {
+				// Cancelled before the caches synced
+				return nil
 			}
-			c.handleUnstructured(new)
-		},
-		DeleteFunc: c.handleUnstructured,
-	})
+			return fmt.Errorf("failed to run controller: %v", err)
+		}
+		return nil
+	}
 
-	kubeInformerFactory.Start(stopCh)
-	dynInformerFactory.Start(stopCh)
-	gatewayInformerFactory.Start(stopCh)
+	if !cfg.LeaderElection.Enabled {
+		err = run(ctx)
+	} else {
+		err = runWithLeaderElection(ctx, kubeClient, cfg.LeaderElection, watchdog, run)
+	}
+	cancel()
+	<-serveDone
+	if serveErr != nil {
+		return fmt.Errorf("diagnostics server failed: %v", serveErr)
+	}
+	return err
+}
 
-	if err = c.run(stopCh); err != nil {
-		klog.Fatalf("Failed to run controller: %v", err)
+// newController returns a controller with the settings of cfg, but without
+// clients, informers, workqueue, metrics and event recorder.
+func newController(cfg *VolumePopulatorConfig, dataSources map[schema.GroupKind]*dataSource) *controller {
+	return &controller{
+		prefix:              cfg.Prefix,
+		populatorNamespace:  cfg.Namespace,
+		devicePath:          cfg.DevicePath,
+		mountPath:           cfg.MountPath,
+		populatedFromAnno:   cfg.Prefix + "/" + populatedFromAnnoSuffix,
+		sourceKindAnno:      cfg.Prefix + "/" + populatedFromKindAnnoSuffix,
+		sourceUIDAnno:       cfg.Prefix + "/" + populatedFromUIDAnnoSuffix,
+		sourceVersionAnno:   cfg.Prefix + "/" + populatedFromVersionAnnoSuffix,
+		sourceGenAnno:       cfg.Prefix + "/" + populatedFromGenAnnoSuffix,
+		imageAnno:           cfg.Prefix + "/" + populatorImageAnnoSuffix,
+		populatedAtAnno:     cfg.Prefix + "/" + populatedAtAnnoSuffix,
+		pvcFinalizer:        cfg.Prefix + "/" + pvcFinalizerSuffix,
+		attemptsAnno:        cfg.Prefix + "/" + populateAttemptsAnnoSuffix,
+		lastFailureAnno:     cfg.Prefix + "/" + populateLastFailureAnnoSuffix,
+		failedAttemptAnno:   cfg.Prefix + "/" + populateFailedAttemptAnnoSuffix,
+		failedAnno:          cfg.Prefix + "/" + populateFailedAnnoSuffix,
+		progressAnno:        cfg.Prefix + "/" + populateProgressAnnoSuffix,
+		failureAnno:         cfg.Prefix + "/" + populateFailureAnnoSuffix,
+		requiredSizeAnno:    cfg.Prefix + "/" + requiredSizeAnnoSuffix,
+		timeoutAnno:         cfg.Prefix + "/" + populationTimeoutAnnoSuffix,
+		completeAnno:        cfg.Prefix + "/" + populateCompleteAnnoSuffix,
+		notifyMap:           make(map[string]*stringSet),
+		cleanupMap:          make(map[string]*stringSet),
+		workers:             cfg.Workers,
+		workerTracker:       newWorkerTracker(),
+		workerStallTimeout:  cfg.WorkerStallTimeout,
+		podMutator:          cfg.PodMutator,
+		pvcPrime:            cfg.PvcPrime,
+		sweeper:             cfg.OrphanSweeper,
+		retryPolicy:         cfg.RetryPolicy,
+		retryPolicyOverride: cfg.RetryPolicyOverride,
+		populationTimeout:   cfg.PopulationTimeout,
+		failureLogLines:     cfg.FailureLogLines,
+		dataSources:         dataSources,
+		dataSourceStatus:    cfg.DataSourceStatus,
+		sourceChangePolicy:  cfg.DataSourceChangePolicy,
+		authorizer:          cfg.Authorizer,
 	}
 }
 
 func getRecorder(kubeClient kubernetes.Interface, controllerName string) record.EventRecorder {
+	eventBroadcaster := newEventBroadcaster(kubeClient)
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
+	return recorder
+}
+
+func newEventBroadcaster(kubeClient kubernetes.Interface) record.EventBroadcaster {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartStructuredLogging(0)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
-	return recorder
+	return eventBroadcaster
 }
 
 func (c *controller) addNotification(keyToCall, objType, namespace, name string) {
@@ -312,6 +688,7 @@ func (c *controller) cleanupNotifications(keyToCall string) {
 			delete(c.notifyMap, key)
 		}
 	}
+	delete(c.cleanupMap, keyToCall)
 }
 
 func translateObject(obj interface{}) metav1.Object {
@@ -375,27 +752,78 @@ func (c *controller) handleSC(obj interface{}) {
 	c.handleMapped(obj, "sc")
 }
 
-func (c *controller) handleUnstructured(obj interface{}) {
-	c.handleMapped(obj, "unstructured")
+// handleUnstructured returns the event handler for data sources of the given
+// kind.
+func (c *controller) handleUnstructured(gk schema.GroupKind) func(obj interface{}) {
+	objType := unstructuredObjType(gk)
+	return func(obj interface{}) {
+		c.handleMapped(obj, objType)
+	}
+}
+
+// unstructuredObjType is the notification type of data sources of the given
+// kind. Data sources of different kinds may have the same name.
+func unstructuredObjType(gk schema.GroupKind) string {
+	return "unstructured/" + gk.String()
 }
 
-func (c *controller) run(stopCh <-chan struct{}) error {
+func (c *controller) run(ctx context.Context) error {
 	defer utilruntime.HandleCrash()
-	defer c.workqueue.ShutDown()
 
-	ok := cache.WaitForCacheSync(stopCh, c.pvcSynced, c.pvSynced, c.podSynced, c.scSynced, c.unstSynced, c.referenceGrantSynced)
+	atomic.StoreInt32(&c.started, 1)
+
+	ok := cache.WaitForCacheSync(ctx.Done(), c.informersSynced()...)
 	if !ok {
+		c.workqueue.ShutDown()
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
-	go wait.Until(c.runWorker, time.Second, stopCh)
+	c.startWorkers(ctx)
+	if c.sweeper.Enabled {
+		c.workersWg.Add(1)
+		go func() {
+			defer c.workersWg.Done()
+			wait.UntilWithContext(ctx, c.sweepOrphans, c.sweeper.Interval)
+		}()
+	}
+
+	<-ctx.Done()
 
-	<-stopCh
+	// Let the workers return from their current item before we do
+	c.workqueue.ShutDown()
+	c.workersWg.Wait()
 
 	return nil
 }
 
-func (c *controller) runWorker() {
+func (c *controller) informersSynced() []cache.InformerSynced {
+	synced := []cache.InformerSynced{c.pvcSynced, c.pvSynced, c.podSynced, c.scSynced}
+	if c.referenceGrantsEnabled() {
+		synced = append(synced, c.referenceGrantSynced)
+	}
+	for _, ds := range c.dataSources {
+		synced = append(synced, ds.synced)
+	}
+	return synced
+}
+
+// startWorkers starts the configured number of workers. The workqueue never
+// hands the same key to two workers at once, so concurrent workers only ever
+// sync different PVCs.
+func (c *controller) startWorkers(ctx context.Context) {
+	for i := 0; i < c.workers; i++ {
+		c.workersWg.Add(1)
+		go func() {
+			defer c.workersWg.Done()
+			wait.UntilWithContext(ctx, c.runWorker, time.Second)
+		}()
+	}
+}
+
+func (c *controller) runWorker(ctx context.Context) {
+	c.workerTracker.workerStarted()
+	defer c.workerTracker.workerStopped()
+
 	processNextWorkItem := func(obj interface{}) error {
 		defer c.workqueue.Done(obj)
 		var key string
@@ -405,6 +833,8 @@ func (c *controller) runWorker() {
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
+		c.workerTracker.syncStarted(key)
+		defer c.workerTracker.syncFinished(key)
 		var err error
 		parts := strings.Split(key, "/")
 		switch parts[0] {
@@ -413,7 +843,7 @@ func (c *controller) runWorker() {
 				utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
 				return nil
 			}
-			err = c.syncPvc(context.TODO(), key, parts[1], parts[2])
+			err = c.syncPvc(ctx, key, parts[1], parts[2])
 		default:
 			utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
 			return nil
@@ -456,46 +886,39 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 		return err
 	}
 
-	dataSourceRef := pvc.Spec.DataSourceRef
-	if dataSourceRef == nil {
-		// Ignore PVCs without a datasource
+	ds, dataSourceRefNamespace := c.dataSourceOf(pvc)
+	if ds == nil {
+		// Ignore PVCs without a datasource, or one that isn't for this
+		// populator to handle
 		return nil
 	}
+	dataSourceRef := pvc.Spec.DataSourceRef
 
-	apiGroup := ""
-	if dataSourceRef.APIGroup != nil {
-		apiGroup = *dataSourceRef.APIGroup
-	}
-	if c.gk.Group != apiGroup || c.gk.Kind != dataSourceRef.Kind || "" == dataSourceRef.Name {
-		// Ignore PVCs that aren't for this populator to handle
-		return nil
+	if pvc.DeletionTimestamp != nil {
+		// Nobody will use the data anymore
+		return c.cancelDeletedPvc(ctx, key, pvc, ds)
 	}
 
-	dataSourceRefNamespace := pvc.Namespace
-	if dataSourceRef.Namespace != nil && pvc.Namespace != *dataSourceRef.Namespace {
-		dataSourceRefNamespace = *dataSourceRef.Namespace
-		// Get all ReferenceGrants in data source's namespace
-		referenceGrants, err := c.referenceGrantLister.ReferenceGrants(*dataSourceRef.Namespace).List(labels.Everything())
-		if err != nil {
-			return fmt.Errorf("error getting ReferenceGrants in %s namespace from api server: %v", *dataSourceRef.Namespace, err)
-		}
-		if allowed, err := IsGranted(ctx, pvc, referenceGrants); err != nil || !allowed {
+	if pvc.Namespace != dataSourceRefNamespace {
+		if allowed, err := c.authorize(ctx, key, pvc); !allowed {
 			return err
 		}
 	}
 
+	// Get notified when the data source is created, changed or deleted
+	c.addNotification(key, unstructuredObjType(ds.gk), dataSourceRefNamespace, dataSourceRef.Name)
 	var unstructured *unstructured.Unstructured
-	unstructured, err = c.unstLister.Namespace(dataSourceRefNamespace).Get(dataSourceRef.Name)
+	unstructured, err = ds.lister.Namespace(dataSourceRefNamespace).Get(dataSourceRef.Name)
 	if err != nil {
 		if !errors.IsNotFound(err) {
 			return err
 		}
-		c.addNotification(key, "unstructured", pvc.Namespace, dataSourceRef.Name)
 		// We'll get called again later when the data source exists
-		return nil
+		return c.handleSourceDeleted(ctx, pvc, dataSourceRefNamespace)
 	}
 
 	var waitForFirstConsumer bool
+	var allowExpansion bool
 	var nodeName string
 	if pvc.Spec.StorageClassName != nil {
 		storageClassName := *pvc.Spec.StorageClassName
@@ -511,23 +934,22 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 			return nil
 		}
 
-		if err := c.checkIntreeStorageClass(pvc, storageClass); err != nil {
+		waitForFirstConsumer, nodeName, err = c.resolveStorageClass(pvc, storageClass)
+		if err != nil {
 			klog.V(2).Infof("Ignoring PVC %s/%s: %s", pvcNamespace, pvcName, err)
 			return nil
 		}
-
-		if storageClass.VolumeBindingMode != nil && storagev1.VolumeBindingWaitForFirstConsumer == *storageClass.VolumeBindingMode {
-			waitForFirstConsumer = true
-			nodeName = pvc.Annotations[annSelectedNode]
-			if nodeName == "" {
-				// Wait for the PVC to get a node name before continuing
-				return nil
-			}
+		if waitForFirstConsumer && nodeName == "" {
+			// Wait for the PVC to get a node name before continuing
+			return nil
 		}
+
+		allowExpansion = storageClass.AllowVolumeExpansion != nil && *storageClass.AllowVolumeExpansion
 	}
 
+	podName, pvcPrimeName := populatorNames(pvc.UID)
+
 	// Look for the populator pod
-	podName := fmt.Sprintf("%s-%s", populatorPodPrefix, pvc.UID)
 	c.addNotification(key, "pod", c.populatorNamespace, podName)
 	var pod *corev1.Pod
 	pod, err = c.podLister.Pods(c.populatorNamespace).Get(podName)
@@ -538,7 +960,6 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 	}
 
 	// Look for PVC'
-	pvcPrimeName := fmt.Sprintf("%s-%s", populatorPvcPrefix, pvc.UID)
 	c.addNotification(key, "pvc", c.populatorNamespace, pvcPrimeName)
 	var pvcPrime *corev1.PersistentVolumeClaim
 	pvcPrime, err = c.pvcLister.PersistentVolumeClaims(c.populatorNamespace).Get(pvcPrimeName)
@@ -553,6 +974,35 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 	// If the PVC is unbound, we need to perform the population
 	if "" == pvc.Spec.VolumeName {
 
+		if _, failed := pvc.Annotations[c.failedAnno]; failed {
+			// We gave up on this PVC, nothing to do until the annotation
+			// is removed
+			return nil
+		}
+
+		if pvcPrime != nil && pvcPrime.DeletionTimestamp != nil {
+			// We'll get called again later when the old PVC' is gone
+			return nil
+		}
+		var restart bool
+		restart, err = c.restartOnSourceChange(ctx, pvc, ds, unstructured, pod, pvcPrime)
+		if err != nil || restart {
+			// We'll get called again later when the pod and PVC' are gone
+			return err
+		}
+
+		retryPolicy := c.getRetryPolicy(unstructured)
+
+		if !hasFinalizer(pvc, c.pvcFinalizer) {
+			// A new population doesn't inherit the failure history of one
+			// we gave up on, so that removing the failed annotation retries
+			// it from scratch
+			err = c.clearRetryState(ctx, pvc, c.attemptsAnno, c.lastFailureAnno, c.failedAttemptAnno, c.progressAnno)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Ensure the PVC has a finalizer on it so we can clean up the stuff we create
 		err = c.ensureFinalizer(ctx, pvc, c.pvcFinalizer, true)
 		if err != nil {
@@ -560,100 +1010,136 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 		}
 
 		// Record start time for populator metric
-		c.metrics.operationStart(pvc.UID)
-
-		// If the pod doesn't exist yet, create it
-		if pod == nil {
-			var rawBlock bool
-			if nil != pvc.Spec.VolumeMode && corev1.PersistentVolumeBlock == *pvc.Spec.VolumeMode {
-				rawBlock = true
-			}
+		metricLabels := c.metricLabels(pvc)
+		c.metrics.operationStart(pvc.UID, metricLabels)
+		c.updateDataSourceStatus(ctx, ds, unstructured, pvc, populationInProgress, "")
 
-			// Calculate the args for the populator pod
-			var args []string
-			args, err = c.populatorArgs(rawBlock, unstructured)
-			if err != nil {
-				return err
-			}
+		var timedOut bool
+		timedOut, err = c.checkTimeout(ctx, key, pvc, ds, unstructured, pod, pvcPrime, retryPolicy, metricLabels)
+		if err != nil || timedOut {
+			return err
+		}
 
-			// Make the pod
-			pod = &corev1.Pod{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      podName,
-					Namespace: c.populatorNamespace,
-				},
-				Spec: makePopulatePodSpec(pvcPrimeName),
-			}
-			pod.Spec.Volumes[0].VolumeSource.PersistentVolumeClaim.ClaimName = pvcPrimeName
-			con := &pod.Spec.Containers[0]
-			con.Image = c.imageName
-			con.Args = args
-			if rawBlock {
-				con.VolumeDevices = []corev1.VolumeDevice{
-					{
-						Name:       populatorPodVolumeName,
-						DevicePath: c.devicePath,
-					},
+		if ds.provider != nil {
+			// Populate PVC' in process instead of running a populator pod
+			if pvcPrime == nil {
+				var wait bool
+				pvc, wait, err = c.waitForRetry(ctx, key, pvc, retryPolicy)
+				if err != nil || wait {
+					return err
 				}
-			} else {
-				con.VolumeMounts = []corev1.VolumeMount{
-					{
-						Name:      populatorPodVolumeName,
-						MountPath: c.mountPath,
-					},
+				// Without a pod, PVC' records which version of the data
+				// source is populated
+				err = c.createPvcPrime(ctx, pvc, ds, pvcPrimeName, nodeName, c.sourceProvenance(ds, unstructured), metricLabels)
+				if err != nil {
+					return err
 				}
+				// We'll get called again later when PVC' exists
+				return nil
 			}
-			if waitForFirstConsumer {
-				pod.Spec.NodeName = nodeName
+			var populated bool
+			populated, err = c.populateWithProvider(ctx, key, ds.provider, c.populatorParams(pvc, pvcPrime, unstructured))
+			if size, ok := requiredSizeFromError(err); ok {
+				var handled bool
+				handled, err = c.handleRequiredSize(ctx, key, pvc, ds, unstructured, nil, pvcPrime, size, allowExpansion)
+				if err != nil || handled {
+					if err == nil {
+						// PVC' may have to be expanded first
+						c.workqueue.AddAfter(key, ds.provider.PollInterval)
+					}
+					return err
+				}
+				// PVC' is big enough, so the provider failed for another
+				// reason
+				err = fmt.Errorf("%s, but PVC' is big enough", err)
+			}
+			if err != nil {
+				return c.attemptFailed(ctx, key, pvc, ds, unstructured, nil, pvcPrime, retryPolicy, metricLabels,
+					reasonPodFailed, err.Error())
 			}
-			_, err = c.kubeClient.CoreV1().Pods(c.populatorNamespace).Create(ctx, pod, metav1.CreateOptions{})
+			if !populated {
+				return nil
+			}
+			err = c.recordComplete(ctx, pvcPrime)
 			if err != nil {
-				c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPodCreationError, "Failed to create populator pod: %s", err)
 				return err
 			}
-			c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPodCreationSuccess, "Populator started")
-
-			// If PVC' doesn't exist yet, create it
-			if pvcPrime == nil {
-				pvcPrime = &corev1.PersistentVolumeClaim{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      pvcPrimeName,
-						Namespace: c.populatorNamespace,
-					},
-					Spec: corev1.PersistentVolumeClaimSpec{
-						AccessModes:      pvc.Spec.AccessModes,
-						Resources:        pvc.Spec.Resources,
-						StorageClassName: pvc.Spec.StorageClassName,
-						VolumeMode:       pvc.Spec.VolumeMode,
-					},
+		} else {
+			// If the pod doesn't exist yet, create it
+			if pod == nil {
+				var wait bool
+				pvc, wait, err = c.waitForRetry(ctx, key, pvc, retryPolicy)
+				if err != nil || wait {
+					return err
 				}
-				if waitForFirstConsumer {
-					pvcPrime.Annotations = map[string]string{
-						annSelectedNode: nodeName,
-					}
+
+				pod, err = c.makePopulatorPod(pvc, ds, unstructured, podName, pvcPrimeName, nodeName, waitForFirstConsumer)
+				if err != nil {
+					return err
 				}
-				_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(c.populatorNamespace).Create(ctx, pvcPrime, metav1.CreateOptions{})
+				err = c.mutatePod(pod, pvc, unstructured)
 				if err != nil {
-					c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPVCCreationError, "Failed to create populator PVC: %s", err)
+					c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPodCreationError, "Failed to customize populator pod: %s", err)
+					c.metrics.recordCreationError(resourcePod, metricLabels)
 					return err
 				}
-			}
+				_, err = c.kubeClient.CoreV1().Pods(c.populatorNamespace).Create(ctx, pod, metav1.CreateOptions{})
+				if err != nil {
+					// If the pod already exists our informer just hasn't seen it
+					// yet, so only make sure PVC' exists too.
+					if !errors.IsAlreadyExists(err) {
+						c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPodCreationError, "Failed to create populator pod: %s", err)
+						c.metrics.recordCreationError(resourcePod, metricLabels)
+						return err
+					}
+				} else {
+					c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPodCreationSuccess, "Populator started")
+				}
 
-			// We'll get called again later when the pod exists
-			return nil
-		}
+				// If PVC' doesn't exist yet, create it
+				if pvcPrime == nil {
+					err = c.createPvcPrime(ctx, pvc, ds, pvcPrimeName, nodeName, nil, metricLabels)
+					if err != nil {
+						return err
+					}
+				}
 
-		if corev1.PodSucceeded != pod.Status.Phase {
-			if corev1.PodFailed == pod.Status.Phase {
-				c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPodFailed, "Populator failed: %s", pod.Status.Message)
-				// Delete failed pods so we can try again
-				err = c.kubeClient.CoreV1().Pods(c.populatorNamespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
-				if err != nil {
+				// We'll get called again later when the pod exists
+				return nil
+			}
+
+			// A reported size wins over the phase: a populator that exits
+			// successfully after the report didn't write all the data
+			if size, ok := c.reportedSize(pod); ok {
+				var handled bool
+				handled, err = c.handleRequiredSize(ctx, key, pvc, ds, unstructured, pod, pvcPrime, size, allowExpansion)
+				if err != nil || handled {
 					return err
 				}
 			}
-			// We'll get called again later when the pod succeeds
-			return nil
+			if corev1.PodSucceeded != pod.Status.Phase {
+				if corev1.PodRunning == pod.Status.Phase {
+					err = c.updateProgress(ctx, pvc, pod)
+					if err != nil {
+						return err
+					}
+				}
+				if corev1.PodFailed == pod.Status.Phase {
+					if pod.DeletionTimestamp != nil {
+						// We already handled this failure and are waiting for
+						// the pod to go away
+						return nil
+					}
+					reason := reasonPodFailed
+					if pod.Status.Reason == podDeadlineExceeded {
+						reason = reasonPopulatorTimeout
+					}
+					return c.attemptFailed(ctx, key, pvc, ds, unstructured, pod, pvcPrime, retryPolicy, metricLabels,
+						reason, c.podFailureMessage(ctx, pod))
+				}
+				// We'll get called again later when the pod succeeds
+				return nil
+			}
 		}
 
 		// This would be bad
@@ -680,7 +1166,7 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 			patchPv := corev1.PersistentVolume{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        pv.Name,
-					Annotations: map[string]string{},
+					Annotations: c.pvProvenance(ds, unstructured, pod, pvcPrime),
 				},
 				Spec: corev1.PersistentVolumeSpec{
 					ClaimRef: &corev1.ObjectReference{
@@ -691,7 +1177,10 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 					},
 				},
 			}
-			patchPv.Annotations[c.populatedFromAnno] = pvc.Namespace + "/" + dataSourceRef.Name
+			err = c.postPopulate(ctx, ds.provider, c.populatorParams(pvc, pvcPrime, unstructured))
+			if err != nil {
+				return err
+			}
 			var patchData []byte
 			patchData, err = json.Marshal(patchPv)
 			if err != nil {
@@ -716,9 +1205,15 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 		}
 	}
 
-	// Record start time for populator metric
+	// Record the duration and result of the population
 	c.metrics.recordMetrics(pvc.UID, "success")
 
+	// Only a population we took part in has finished here, not every bound
+	// PVC with this data source
+	if pvcPrime != nil || hasFinalizer(pvc, c.pvcFinalizer) {
+		c.updateDataSourceStatus(ctx, ds, unstructured, pvc, populationSucceeded, "")
+	}
+
 	// *** At this point the volume population is done and we're just cleaning up ***
 	c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPodFinished, "Populator finished")
 
@@ -738,6 +1233,14 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 		}
 	}
 
+	// The failures and progress of a population that succeeded don't
+	// matter anymore
+	err = c.clearRetryState(ctx, pvc, c.attemptsAnno, c.lastFailureAnno, c.failedAttemptAnno, c.failureAnno,
+		c.progressAnno)
+	if err != nil {
+		return err
+	}
+
 	// Make sure the PVC finalizer is gone
 	err = c.ensureFinalizer(ctx, pvc, c.pvcFinalizer, false)
 	if err != nil {
@@ -750,12 +1253,362 @@ func (c *controller) syncPvc(ctx context.Context, key, pvcNamespace, pvcName str
 	return nil
 }
 
+// attemptFailed handles a failed attempt to populate a PVC, which is a failed
+// populator pod or a failed provider function. It records the failure, and
+// cleans up the attempt so that population is retried, or gives up once the
+// retry policy says so.
+func (c *controller) attemptFailed(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim, ds *dataSource,
+	source *unstructured.Unstructured, pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim,
+	retryPolicy RetryPolicy, metricLabels sourceLabels, reason, message string,
+) error {
+	// Our listers may still show an attempt we already handled, so check the
+	// failure history on the API server first
+	pvc, state, err := c.readRetryState(ctx, pvc)
+	if err != nil {
+		return err
+	}
+	attempt := attemptUID(ds, pod, pvcPrime)
+	if attempt != "" && state.failedAttempt == attempt {
+		// We'll get called again later when the attempt is gone
+		return c.cleanupAttempt(ctx, ds, pod, pvcPrime)
+	}
+
+	c.recorder.Eventf(pvc, corev1.EventTypeWarning, reason, "Populator failed: %s", message)
+	c.metrics.recordPodFailure(metricLabels)
+	err = c.setFailureAnnotation(ctx, pvc, message)
+	if err != nil {
+		return err
+	}
+	// Record the failure before cleaning up the attempt, so it is counted
+	// even if we crash in between
+	state.failedAttempt = attempt
+	if retryPolicy.enabled() {
+		state.attempts++
+		state.lastFailure = time.Now()
+		if retryPolicy.MaxAttempts > 0 && state.attempts >= retryPolicy.MaxAttempts {
+			err = c.failPopulation(ctx, key, pvc, pod, pvcPrime, state)
+			if err != nil {
+				return err
+			}
+			c.updateDataSourceStatus(ctx, ds, source, pvc, populationFailed, message)
+			return nil
+		}
+	}
+	err = c.setRetryState(ctx, pvc, state)
+	if err != nil {
+		return err
+	}
+	c.metrics.recordRetry(metricLabels)
+	c.metrics.clearProgress(pvc.UID)
+	return c.cleanupAttempt(ctx, ds, pod, pvcPrime)
+}
+
+// attemptUID returns the UID of the object that identifies an attempt to
+// populate a PVC: the populator pod, or PVC' with provider functions.
+func attemptUID(ds *dataSource, pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim) types.UID {
+	if ds.provider != nil {
+		if pvcPrime == nil {
+			return ""
+		}
+		return pvcPrime.UID
+	}
+	if pod == nil {
+		return ""
+	}
+	return pod.UID
+}
+
+// cleanupAttempt deletes what a failed attempt leaves behind, so we can try
+// again. That is the populator pod, or PVC' with provider functions, which
+// populate the volume of PVC' in place.
+func (c *controller) cleanupAttempt(ctx context.Context, ds *dataSource, pod *corev1.Pod,
+	pvcPrime *corev1.PersistentVolumeClaim,
+) error {
+	if ds.provider != nil {
+		if pvcPrime == nil {
+			return nil
+		}
+		err := c.kubeClient.CoreV1().PersistentVolumeClaims(c.populatorNamespace).Delete(ctx, pvcPrime.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	err := c.kubeClient.CoreV1().Pods(c.populatorNamespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// metricLabels returns the optional metric labels for a population.
+func (c *controller) metricLabels(pvc *corev1.PersistentVolumeClaim) sourceLabels {
+	var labels sourceLabels
+	if ref := pvc.Spec.DataSourceRef; ref != nil {
+		gk := dataSourceGroupKind(ref)
+		labels.group, labels.kind = gk.Group, gk.Kind
+	}
+	if pvc.Spec.StorageClassName != nil {
+		labels.storageClass = *pvc.Spec.StorageClassName
+	}
+	return labels
+}
+
+// getRetryPolicy returns the retry policy for the given data source.
+func (c *controller) getRetryPolicy(dataSource *unstructured.Unstructured) RetryPolicy {
+	if c.retryPolicyOverride != nil {
+		if policy := c.retryPolicyOverride(dataSource); policy != nil {
+			p := *policy
+			p.setDefaults()
+			return p
+		}
+	}
+	return c.retryPolicy
+}
+
+// failPopulation gives up on a population once it ran out of retries. It marks
+// the PVC as failed, removes the populator pod and PVC' and releases the PVC.
+func (c *controller) failPopulation(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim,
+	pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim, state retryState,
+) error {
+	state.message = fmt.Sprintf("populator failed %d times", state.attempts)
+	c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonRetriesExhausted, "Populator failed %d times, giving up", state.attempts)
+	return c.abandonPopulation(ctx, key, pvc, pod, pvcPrime, state)
+}
+
+// abandonPopulation marks the PVC as failed with state.message, removes the
+// populator pod and PVC' and releases the PVC.
+func (c *controller) abandonPopulation(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim,
+	pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim, state retryState,
+) error {
+	state.failed = true
+	err := c.setRetryState(ctx, pvc, state)
+	if err != nil {
+		return err
+	}
+	c.metrics.recordMetrics(pvc.UID, "failed")
+
+	if pod != nil {
+		err = c.kubeClient.CoreV1().Pods(c.populatorNamespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	if pvcPrime != nil {
+		err = c.kubeClient.CoreV1().PersistentVolumeClaims(c.populatorNamespace).Delete(ctx, pvcPrime.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	err = c.ensureFinalizer(ctx, pvc, c.pvcFinalizer, false)
+	if err != nil {
+		return err
+	}
+	c.cleanupNotifications(key)
+	return nil
+}
+
+// cancelDeletedPvc stops the population of a PVC that is being deleted, so
+// that our finalizer doesn't keep it around until the populator finishes.
+func (c *controller) cancelDeletedPvc(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim, ds *dataSource) error {
+	if c.populationInFlight(pvc) {
+		c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPopulatorCancelled, "PVC is being deleted, stopping population")
+		c.metrics.recordMetrics(pvc.UID, "cancelled")
+		dataSourceRef := pvc.Spec.DataSourceRef
+		namespace := pvc.Namespace
+		if dataSourceRef.Namespace != nil && *dataSourceRef.Namespace != "" {
+			namespace = *dataSourceRef.Namespace
+		}
+		source, err := ds.lister.Namespace(namespace).Get(dataSourceRef.Name)
+		if err == nil {
+			c.updateDataSourceStatus(ctx, ds, source, pvc, populationFailed, "the PVC was deleted")
+		}
+	}
+	err := c.cancelPopulation(ctx, pvc)
+	if err != nil {
+		return err
+	}
+	c.cleanupNotifications(key)
+	return nil
+}
+
+// populatorNames returns the names of the populator pod and PVC' of the PVC
+// with the given UID.
+func populatorNames(uid types.UID) (podName, pvcPrimeName string) {
+	return fmt.Sprintf("%s-%s", populatorPodPrefix, uid), fmt.Sprintf("%s-%s", populatorPvcPrefix, uid)
+}
+
+// cancelPopulation deletes the populator pod and PVC' of a PVC, if any, and
+// releases the PVC.
+func (c *controller) cancelPopulation(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if !hasFinalizer(pvc, c.pvcFinalizer) {
+		// Nothing was started for this PVC
+		return nil
+	}
+	podName, pvcPrimeName := populatorNames(pvc.UID)
+	err := c.kubeClient.CoreV1().Pods(c.populatorNamespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	err = c.kubeClient.CoreV1().PersistentVolumeClaims(c.populatorNamespace).Delete(ctx, pvcPrimeName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	c.metrics.dropOperation(pvc.UID)
+	return c.ensureFinalizer(ctx, pvc, c.pvcFinalizer, false)
+}
+
+// createPvcPrime creates PVC', the PVC in the populator namespace whose volume
+// is populated and then moved to pvc.
+func (c *controller) createPvcPrime(ctx context.Context, pvc *corev1.PersistentVolumeClaim, ds *dataSource,
+	pvcPrimeName, nodeName string, annotations map[string]string, metricLabels sourceLabels,
+) error {
+	pvcPrime, err := c.makePvcPrime(pvc, ds, pvcPrimeName, nodeName, annotations)
+	if err != nil {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPVCCreationError, "Failed to create populator PVC: %s", err)
+		c.metrics.recordCreationError(resourcePVC, metricLabels)
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(c.populatorNamespace).Create(ctx, pvcPrime, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPVCCreationError, "Failed to create populator PVC: %s", err)
+		c.metrics.recordCreationError(resourcePVC, metricLabels)
+		return err
+	}
+	return nil
+}
+
+// makePvcPrime returns PVC' for a PVC. If nodeName is not empty, the volume
+// is provisioned on that node.
+func (c *controller) makePvcPrime(pvc *corev1.PersistentVolumeClaim, ds *dataSource,
+	pvcPrimeName, nodeName string, annotations map[string]string,
+) (*corev1.PersistentVolumeClaim, error) {
+	pvcPrime := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvcPrimeName,
+			Namespace:   c.populatorNamespace,
+			Labels:      c.pvcPrimeLabels(pvc, ds),
+			Annotations: c.pvcPrimeAnnotations(pvc, annotations),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      pvc.Spec.AccessModes,
+			Resources:        c.pvcPrimeResources(pvc),
+			StorageClassName: pvc.Spec.StorageClassName,
+			VolumeMode:       pvc.Spec.VolumeMode,
+		},
+	}
+	if c.pvcPrime.Mutator != nil {
+		err := c.pvcPrime.Mutator(pvcPrime, pvc)
+		if err != nil {
+			return nil, err
+		}
+		if pvcPrime.Name != pvcPrimeName || pvcPrime.Namespace != c.populatorNamespace {
+			return nil, fmt.Errorf("PVC' mutator must not change the name or namespace of PVC' %s/%s", c.populatorNamespace, pvcPrimeName)
+		}
+	}
+	if nodeName != "" {
+		if pvcPrime.Annotations == nil {
+			pvcPrime.Annotations = map[string]string{}
+		}
+		pvcPrime.Annotations[annSelectedNode] = nodeName
+	} else {
+		// Only the scheduler picks the node of PVC'
+		delete(pvcPrime.Annotations, annSelectedNode)
+	}
+	return pvcPrime, nil
+}
+
+// makePopulatorPod returns the pod that writes the data of source into PVC'.
+// The pod mutator is not applied.
+func (c *controller) makePopulatorPod(pvc *corev1.PersistentVolumeClaim, ds *dataSource, source *unstructured.Unstructured,
+	podName, pvcPrimeName, nodeName string, waitForFirstConsumer bool,
+) (*corev1.Pod, error) {
+	var rawBlock bool
+	if nil != pvc.Spec.VolumeMode && corev1.PersistentVolumeBlock == *pvc.Spec.VolumeMode {
+		rawBlock = true
+	}
+
+	// Calculate the args for the populator pod
+	args, err := ds.populatorArgs(rawBlock, source)
+	if err != nil {
+		return nil, err
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podName,
+			Namespace: c.populatorNamespace,
+			Labels:    c.artifactLabels(pvc, ds),
+			// Record which version of the data source is populated
+			Annotations: c.sourceProvenance(ds, source),
+		},
+		Spec: makePopulatePodSpec(pvcPrimeName),
+	}
+	pod.Spec.Volumes[0].VolumeSource.PersistentVolumeClaim.ClaimName = pvcPrimeName
+	con := &pod.Spec.Containers[0]
+	con.Image = ds.imageName
+	con.Args = args
+	if rawBlock {
+		con.VolumeDevices = []corev1.VolumeDevice{
+			{
+				Name:       populatorPodVolumeName,
+				DevicePath: c.devicePath,
+			},
+		}
+	} else {
+		con.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      populatorPodVolumeName,
+				MountPath: c.mountPath,
+			},
+		}
+	}
+	if waitForFirstConsumer {
+		pod.Spec.NodeName = nodeName
+	}
+	setPodDeadline(pod, c.sourceTimeout(source))
+	return pod, nil
+}
+
+// mutatePod applies the pod mutator to a populator pod.
+func (c *controller) mutatePod(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim, source *unstructured.Unstructured) error {
+	if c.podMutator == nil {
+		return nil
+	}
+	name := pod.Name
+	err := c.podMutator(pod, pvc, source)
+	if err != nil {
+		return err
+	}
+	if pod.Name != name || pod.Namespace != c.populatorNamespace {
+		return fmt.Errorf("pod mutator must not change the name or namespace of populator pod %s/%s", c.populatorNamespace, name)
+	}
+	return nil
+}
+
 func makePopulatePodSpec(pvcPrimeName string) corev1.PodSpec {
 	return corev1.PodSpec{
 		Containers: []corev1.Container{
 			{
 				Name:            populatorContainerName,
 				ImagePullPolicy: corev1.PullIfNotPresent,
+				// Use the end of the logs if the populator didn't write a
+				// termination message, so that failures can be reported
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+				Env: []corev1.EnvVar{
+					{
+						Name: podNameEnv,
+						ValueFrom: &corev1.EnvVarSource{
+							FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+						},
+					},
+					{
+						Name: podNamespaceEnv,
+						ValueFrom: &corev1.EnvVarSource{
+							FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+						},
+					},
+				},
 			},
 		},
 		RestartPolicy: corev1.RestartPolicyNever,
@@ -772,6 +1625,15 @@ func makePopulatePodSpec(pvcPrimeName string) corev1.PodSpec {
 	}
 }
 
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *controller) ensureFinalizer(ctx context.Context, pvc *corev1.PersistentVolumeClaim, finalizer string, want bool) error {
 	finalizers := pvc.GetFinalizers()
 	found := false
@@ -839,6 +1701,20 @@ func (c *controller) ensureFinalizer(ctx context.Context, pvc *corev1.Persistent
 	return nil
 }
 
+// resolveStorageClass checks the StorageClass of a PVC and returns whether
+// its volumes are provisioned for the first consumer, and on which node.
+// nodeName is empty until the scheduler picked a node for the PVC.
+func (c *controller) resolveStorageClass(pvc *corev1.PersistentVolumeClaim, storageClass *storagev1.StorageClass,
+) (waitForFirstConsumer bool, nodeName string, err error) {
+	if err := c.checkIntreeStorageClass(pvc, storageClass); err != nil {
+		return false, "", err
+	}
+	if storageClass.VolumeBindingMode != nil && storagev1.VolumeBindingWaitForFirstConsumer == *storageClass.VolumeBindingMode {
+		return true, pvc.Annotations[annSelectedNode], nil
+	}
+	return false, "", nil
+}
+
 func (c *controller) checkIntreeStorageClass(pvc *corev1.PersistentVolumeClaim, sc *storagev1.StorageClass) error {
 	if !strings.HasPrefix(sc.Provisioner, "kubernetes.io/") {
 		// This is not an in-tree StorageClass
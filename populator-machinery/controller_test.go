@@ -20,6 +20,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,6 +33,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/dynamic/dynamiclister"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
@@ -38,10 +41,11 @@ import (
 	informercorev1 "k8s.io/client-go/informers/core/v1"
 	informerstoragev1 "k8s.io/client-go/informers/storage/v1"
 	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
-	gatewayfake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
-	gatewayInformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 )
 
 type testCase struct {
@@ -53,7 +57,7 @@ type testCase struct {
 	// PVC to be processed
 	pvcName string
 
-	// Object to insert into fake kubeclient/dynClient/gatewayClient before the test starts
+	// Object to insert into fake kubeclient/dynClient before the test starts
 	initialObjects []runtime.Object
 	// Expected errors
 	expectedResult error
@@ -186,7 +190,6 @@ func initTest() (
 
 	kubeClient := kubefake.NewSimpleClientset()
 	dynClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
-	gatewayClient := gatewayfake.NewSimpleClientset()
 
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
 	dynInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynClient, time.Second*30)
@@ -197,23 +200,55 @@ func initTest() (
 	scInformer := kubeInformerFactory.Storage().V1().StorageClasses()
 	unstInformer := dynInformerFactory.ForResource(gvr).Informer()
 
-	gatewayInformerFactory := gatewayInformers.NewSharedInformerFactory(gatewayClient, time.Second*30)
-	referenceGrants := gatewayInformerFactory.Gateway().V1beta1().ReferenceGrants()
+	referenceGrantGVR := gatewayv1beta1.SchemeGroupVersion.WithResource(referenceGrantResource)
+	referenceGrants := dynInformerFactory.ForResource(referenceGrantGVR).Informer()
 
 	populatorArgs := func(b bool, u *unstructured.Unstructured) ([]string, error) {
 		var args []string
 		return args, nil
 	}
 
+	pvcInformer.Informer().AddIndexers(cache.Indexers{
+		dataSourceNamespaceIndex: dataSourceNamespaceIndexFunc,
+		pvcUIDIndex:              pvcUIDIndexFunc,
+	})
+
+	dataSources := map[schema.GroupKind]*dataSource{
+		gk: {
+			gk:            gk,
+			gvr:           gvr,
+			populatorArgs: populatorArgs,
+			lister:        dynamiclister.New(unstInformer.GetIndexer(), gvr),
+			synced:        unstInformer.HasSynced,
+		},
+	}
+
 	c := &controller{
 		kubeClient:           kubeClient,
-		imageName:            "",
+		dynClient:            dynClient,
+		prefix:               testPrefix,
 		populatorNamespace:   testVpWorkingNamespace,
 		devicePath:           "",
 		mountPath:            "",
 		populatedFromAnno:    testPrefix + "/" + populatedFromAnnoSuffix,
+		sourceKindAnno:       testPrefix + "/" + populatedFromKindAnnoSuffix,
+		sourceUIDAnno:        testPrefix + "/" + populatedFromUIDAnnoSuffix,
+		sourceVersionAnno:    testPrefix + "/" + populatedFromVersionAnnoSuffix,
+		sourceGenAnno:        testPrefix + "/" + populatedFromGenAnnoSuffix,
+		imageAnno:            testPrefix + "/" + populatorImageAnnoSuffix,
+		populatedAtAnno:      testPrefix + "/" + populatedAtAnnoSuffix,
 		pvcFinalizer:         testPrefix + "/" + pvcFinalizerSuffix,
+		attemptsAnno:         testPrefix + "/" + populateAttemptsAnnoSuffix,
+		lastFailureAnno:      testPrefix + "/" + populateLastFailureAnnoSuffix,
+		failedAttemptAnno:    testPrefix + "/" + populateFailedAttemptAnnoSuffix,
+		failedAnno:           testPrefix + "/" + populateFailedAnnoSuffix,
+		progressAnno:         testPrefix + "/" + populateProgressAnnoSuffix,
+		failureAnno:          testPrefix + "/" + populateFailureAnnoSuffix,
+		requiredSizeAnno:     testPrefix + "/" + requiredSizeAnnoSuffix,
+		timeoutAnno:          testPrefix + "/" + populationTimeoutAnnoSuffix,
+		completeAnno:         testPrefix + "/" + populateCompleteAnnoSuffix,
 		pvcLister:            pvcInformer.Lister(),
+		pvcIndexer:           pvcInformer.Informer().GetIndexer(),
 		pvcSynced:            pvcInformer.Informer().HasSynced,
 		pvLister:             pvInformer.Lister(),
 		pvSynced:             pvInformer.Informer().HasSynced,
@@ -221,18 +256,20 @@ func initTest() (
 		podSynced:            podInformer.Informer().HasSynced,
 		scLister:             scInformer.Lister(),
 		scSynced:             scInformer.Informer().HasSynced,
-		unstLister:           dynamiclister.New(unstInformer.GetIndexer(), gvr),
-		unstSynced:           unstInformer.HasSynced,
 		notifyMap:            make(map[string]*stringSet),
 		cleanupMap:           make(map[string]*stringSet),
 		workqueue:            workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		populatorArgs:        populatorArgs,
-		gk:                   gk,
+		workers:              defaultWorkers,
+		workerTracker:        newWorkerTracker(),
+		workerStallTimeout:   defaultWorkerStallTimeout,
+		dataSources:          dataSources,
 		metrics:              initMetrics(),
 		recorder:             getRecorder(kubeClient, testPrefix+"-"+controllerNameSuffix),
-		referenceGrantLister: referenceGrants.Lister(),
-		referenceGrantSynced: referenceGrants.Informer().HasSynced,
+		referenceGrantLister: dynamiclister.New(referenceGrants.GetIndexer(), referenceGrantGVR),
+		referenceGrantSynced: referenceGrants.HasSynced,
+		referenceGrantsFound: 1,
 	}
+	c.authorizer = &referenceGrantAuthorizer{c}
 	return c, pvcInformer, unstInformer, scInformer, podInformer, pvInformer
 }
 
@@ -258,41 +295,71 @@ func compareNotifyMap(want []string, got map[string]*stringSet) error {
 	return nil
 }
 
+// initSyncTest returns a test controller with a fake event recorder. The
+// objects are added to its fake clients and informer caches.
+func initSyncTest(t *testing.T, objects ...runtime.Object) (*controller, *record.FakeRecorder) {
+	c, pvcInformer, unstInformer, scInformer, podInformer, pvInformer := initTest()
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+	for _, obj := range objects {
+		switch obj.(type) {
+		case *v1.PersistentVolumeClaim:
+			pvc := obj.(*v1.PersistentVolumeClaim)
+			_, err := c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Create(context.TODO(), pvc, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("Create pvc failed: %s", err.Error())
+			}
+			pvcInformer.Informer().GetStore().Add(obj)
+		case *unstructured.Unstructured:
+			u := obj.(*unstructured.Unstructured)
+			if ds := c.dataSources[u.GroupVersionKind().GroupKind()]; ds != nil {
+				_, err := c.dynClient.Resource(ds.gvr).Namespace(u.GetNamespace()).Create(context.TODO(), u, metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("Create data source failed: %s", err.Error())
+				}
+			}
+			unstInformer.GetStore().Add(obj)
+		case *storagev1.StorageClass:
+			scInformer.Informer().GetStore().Add(obj)
+		case *v1.Pod:
+			pod := obj.(*v1.Pod)
+			_, err := c.kubeClient.CoreV1().Pods(pod.ObjectMeta.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("Create pod failed: %s", err.Error())
+			}
+			podInformer.Informer().GetStore().Add(obj)
+		case *v1.PersistentVolume:
+			pv := obj.(*v1.PersistentVolume)
+			_, err := c.kubeClient.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("Create pv failed: %s", err.Error())
+			}
+			pvInformer.Informer().GetStore().Add(obj)
+		default:
+			t.Fatalf("Unknown initalObject type: %+v", obj)
+		}
+	}
+	return c, recorder
+}
+
+// populatingPvc returns the test PVC with a data source, with the finalizer
+// the controller adds while it populates the PVC.
+func populatingPvc() *v1.PersistentVolumeClaim {
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	claim.Finalizers = append(claim.Finalizers, testPrefix+"/"+pvcFinalizerSuffix)
+	return claim
+}
+
+// syncTestPvc syncs the test PVC.
+func syncTestPvc(c *controller) error {
+	return c.syncPvc(context.TODO(), "pvc/"+testPvcNamespace+"/"+testPvcName, testPvcNamespace, testPvcName)
+}
+
 func runSyncPvcTests(tests []testCase, t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			c, pvcInformer, unstInformer, scInformer, podInformer, pvInformer := initTest()
-			for _, obj := range test.initialObjects {
-				switch obj.(type) {
-				case *v1.PersistentVolumeClaim:
-					pvc := obj.(*v1.PersistentVolumeClaim)
-					_, err := c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Create(context.TODO(), pvc, metav1.CreateOptions{})
-					if err != nil {
-						t.Fatalf("Create pvc failed: %s", err.Error())
-					}
-					pvcInformer.Informer().GetStore().Add(obj)
-				case *unstructured.Unstructured:
-					unstInformer.GetStore().Add(obj)
-				case *storagev1.StorageClass:
-					scInformer.Informer().GetStore().Add(obj)
-				case *v1.Pod:
-					pod := obj.(*v1.Pod)
-					_, err := c.kubeClient.CoreV1().Pods(pod.ObjectMeta.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
-					if err != nil {
-						t.Fatalf("Create pod failed: %s", err.Error())
-					}
-					podInformer.Informer().GetStore().Add(obj)
-				case *v1.PersistentVolume:
-					pv := obj.(*v1.PersistentVolume)
-					_, err := c.kubeClient.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
-					if err != nil {
-						t.Fatalf("Create pv failed: %s", err.Error())
-					}
-					pvInformer.Informer().GetStore().Add(obj)
-				default:
-					t.Fatalf("Unknown initalObject type: %+v", obj)
-				}
-			}
+			c, _ := initSyncTest(t, test.initialObjects...)
 
 			result := c.syncPvc(context.TODO(), test.key, test.pvcNamespace, test.pvcName)
 			if !compareResult(test.expectedResult, result) {
@@ -307,7 +374,7 @@ func runSyncPvcTests(tests []testCase, t *testing.T) {
 }
 
 func TestSyncPvc(t *testing.T) {
-	dataSourceKey := "unstructured/" + testPvcNamespace + "/" + testDataSourceName
+	dataSourceKey := "unstructured/" + testDatasourceKind + "." + testApiGroup + "/" + testPvcNamespace + "/" + testDataSourceName
 	storageClassKey := "sc/" + testStorageClassName
 	podKey := "pod/" + testVpWorkingNamespace + "/" + testPodName
 	pvcPrimeKey := "pvc/" + testVpWorkingNamespace + "/" + testPopulatorPvcName
@@ -389,7 +456,7 @@ func TestSyncPvc(t *testing.T) {
 				pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
 					dsf(testApiGroup, testDatasourceKind, testDataSourceName, "default1"), ""),
 			},
-			expectedResult: errors.New("accessing default1/test-data-source-name of TestKind dataSource from default/test-pvc isn't allowed"),
+			expectedResult: nil,
 			expectedKeys:   []string{},
 		},
 		{
@@ -415,7 +482,7 @@ func TestSyncPvc(t *testing.T) {
 				ust(),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{storageClassKey},
+			expectedKeys:   []string{dataSourceKey, storageClassKey},
 		},
 		{
 			name:         "PVC not bound to a node",
@@ -429,7 +496,7 @@ func TestSyncPvc(t *testing.T) {
 				sc(),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{},
+			expectedKeys:   []string{dataSourceKey},
 		},
 		{
 			name:         "Create populator pod",
@@ -443,7 +510,7 @@ func TestSyncPvc(t *testing.T) {
 				sc(),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{podKey, pvcPrimeKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey},
 		},
 		{
 			name:         "Wait populator pod succeed",
@@ -458,7 +525,7 @@ func TestSyncPvc(t *testing.T) {
 				pod(corev1.PodRunning),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{podKey, pvcPrimeKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey},
 		},
 		{
 			name:         "Populator pod failed",
@@ -473,7 +540,7 @@ func TestSyncPvc(t *testing.T) {
 				pod(corev1.PodFailed),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{podKey, pvcPrimeKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey},
 		},
 
 		{
@@ -489,7 +556,7 @@ func TestSyncPvc(t *testing.T) {
 				pod(corev1.PodSucceeded),
 			},
 			expectedResult: errors.New("Failed to find PVC for populator pod"),
-			expectedKeys:   []string{podKey, pvcPrimeKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey},
 		},
 		{
 			name:         "PV not exists",
@@ -505,7 +572,7 @@ func TestSyncPvc(t *testing.T) {
 				pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, ""),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{podKey, pvcPrimeKey, pvKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey, pvKey},
 		},
 		{
 			name:         "Wait for the bind controller to rebind the PV",
@@ -522,7 +589,7 @@ func TestSyncPvc(t *testing.T) {
 				pv(testPvcName, testPvcNamespace, testPvcUid),
 			},
 			expectedResult: nil,
-			expectedKeys:   []string{podKey, pvcPrimeKey, pvKey},
+			expectedKeys:   []string{dataSourceKey, podKey, pvcPrimeKey, pvKey},
 		},
 		{
 			name:         "Clean up populator pod and pvcPrime",
@@ -545,3 +612,533 @@ func TestSyncPvc(t *testing.T) {
 
 	runSyncPvcTests(tests, t)
 }
+
+func TestValidateConfig(t *testing.T) {
+	populatorArgs := func(b bool, u *unstructured.Unstructured) ([]string, error) {
+		return nil, nil
+	}
+	validConfig := func() VolumePopulatorConfig {
+		return VolumePopulatorConfig{
+			ImageName: "test-image",
+			Namespace: testVpWorkingNamespace,
+			Prefix:    testPrefix,
+			Gk:        schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind},
+			Gvr: schema.GroupVersionResource{
+				Group:    testApiGroup,
+				Version:  "v1alpha1",
+				Resource: "testdatasources",
+			},
+			PopulatorArgs: populatorArgs,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(cfg *VolumePopulatorConfig)
+		wantErr bool
+	}{
+		{
+			name:   "Valid config",
+			mutate: func(cfg *VolumePopulatorConfig) {},
+		},
+		{
+			name:    "Missing namespace",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Namespace = "" },
+			wantErr: true,
+		},
+		{
+			name:    "Missing prefix",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Prefix = "" },
+			wantErr: true,
+		},
+		{
+			name:    "Missing kind",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Gk.Kind = "" },
+			wantErr: true,
+		},
+		{
+			name:    "Missing resource",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Gvr.Resource = "" },
+			wantErr: true,
+		},
+		{
+			name:    "Mismatched group",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Gvr.Group = "other.api.group" },
+			wantErr: true,
+		},
+		{
+			name:    "Missing image",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.ImageName = "" },
+			wantErr: true,
+		},
+		{
+			name:   "Restart on data source change",
+			mutate: func(cfg *VolumePopulatorConfig) { cfg.DataSourceChangePolicy = DataSourceChangeRestart },
+		},
+		{
+			name:    "Unknown data source change policy",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.DataSourceChangePolicy = "ignore" },
+			wantErr: true,
+		},
+		{
+			name: "Propagated PVC metadata",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.PvcPrime.Labels = []string{PropagateAll}
+				cfg.PvcPrime.Annotations = []string{"example.com/team"}
+			},
+		},
+		{
+			name:    "Invalid propagated label key",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.PvcPrime.Labels = []string{"not a key"} },
+			wantErr: true,
+		},
+		{
+			name:    "Negative population timeout",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.PopulationTimeout = -time.Minute },
+			wantErr: true,
+		},
+		{
+			name:    "Negative orphan grace period",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.OrphanSweeper.GracePeriod = -time.Minute },
+			wantErr: true,
+		},
+		{
+			name:    "Negative workers",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.Workers = -1 },
+			wantErr: true,
+		},
+		{
+			name: "Leader election renew deadline too long",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.LeaderElection.Enabled = true
+				cfg.LeaderElection.RenewDeadline = cfg.LeaderElection.LeaseDuration
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Missing populator args",
+			mutate:  func(cfg *VolumePopulatorConfig) { cfg.PopulatorArgs = nil },
+			wantErr: true,
+		},
+		{
+			name: "Provider without image",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.ImageName = ""
+				cfg.PopulatorArgs = nil
+				cfg.ProviderFunctionConfig = &ProviderFunctionConfig{
+					PopulateFn:         func(context.Context, PopulatorParams) error { return nil },
+					PopulateCompleteFn: func(context.Context, PopulatorParams) (bool, error) { return true, nil },
+				}
+			},
+		},
+		{
+			name: "Provider without populate complete function",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.ProviderFunctionConfig = &ProviderFunctionConfig{
+					PopulateFn: func(context.Context, PopulatorParams) error { return nil },
+				}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.setDefaults()
+			test.mutate(&cfg)
+			err := cfg.validate()
+			if test.wantErr != (err != nil) {
+				t.Errorf("Expected error %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	err := Run(context.TODO(), VolumePopulatorConfig{})
+	if err == nil {
+		t.Errorf("Expected error for empty config")
+	}
+}
+
+func countEvents(recorder *record.FakeRecorder, reason string) int {
+	count := 0
+	for {
+		select {
+		case event := <-recorder.Events:
+			if strings.Contains(event, " "+reason+" ") {
+				count++
+			}
+		default:
+			return count
+		}
+	}
+}
+
+func TestConcurrentSyncSameKey(t *testing.T) {
+	c, pvcInformer, unstInformer, scInformer, podInformer, _ := initTest()
+	recorder := record.NewFakeRecorder(1000)
+	c.recorder = recorder
+	c.workers = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopCh := ctx.Done()
+	go pvcInformer.Informer().Run(stopCh)
+	go podInformer.Informer().Run(stopCh)
+
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	if _, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Create(context.TODO(), claim, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create pvc failed: %v", err)
+	}
+	unstInformer.GetStore().Add(ust())
+	scInformer.Informer().GetStore().Add(sc())
+	if !cache.WaitForCacheSync(stopCh, pvcInformer.Informer().HasSynced, podInformer.Informer().HasSynced) {
+		t.Fatalf("Failed to sync informers")
+	}
+
+	c.startWorkers(ctx)
+
+	key := "pvc/" + testPvcNamespace + "/" + testPvcName
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				c.workqueue.Add(key)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		if c.workqueue.Len() != 0 {
+			return false, nil
+		}
+		if _, err := c.podLister.Pods(testVpWorkingNamespace).Get(testPodName); err != nil {
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("Populator pod was not created: %v", err)
+	}
+	c.workqueue.ShutDownWithDrain()
+
+	if n := countEvents(recorder, reasonPodCreationSuccess); n != 1 {
+		t.Errorf("Expected populator pod to be created once, got %d", n)
+	}
+	pvcs, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("List pvcs failed: %v", err)
+	}
+	if len(pvcs.Items) != 1 {
+		t.Errorf("Expected 1 PVC', got %d", len(pvcs.Items))
+	}
+}
+
+func TestConcurrentSyncDifferentKeys(t *testing.T) {
+	c, pvcInformer, unstInformer, scInformer, _, _ := initTest()
+	c.workers = 2
+
+	// Block the populator args function for the first PVC until the second
+	// PVC has been handled by another worker.
+	blockedPvcName := testPvcName + "-blocked"
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+	testGk := schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}
+	c.dataSources[testGk].populatorArgs = func(b bool, u *unstructured.Unstructured) ([]string, error) {
+		if u.GetLabels()["block"] == "true" {
+			close(blocked)
+			<-unblock
+		}
+		return nil, nil
+	}
+
+	blockedSource := ust()
+	blockedSource.SetName(testDataSourceName + "-blocked")
+	blockedSource.SetLabels(map[string]string{"block": "true"})
+	blockedPvc := pvc(blockedPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, blockedSource.GetName(), testPvcNamespace), "")
+	blockedPvc.UID = "blocked-uid"
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	for _, p := range []*v1.PersistentVolumeClaim{blockedPvc, claim} {
+		if _, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Create(context.TODO(), p, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Create pvc failed: %v", err)
+		}
+		pvcInformer.Informer().GetStore().Add(p)
+	}
+	unstInformer.GetStore().Add(blockedSource)
+	unstInformer.GetStore().Add(ust())
+	scInformer.Informer().GetStore().Add(sc())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.startWorkers(ctx)
+
+	c.workqueue.Add("pvc/" + testPvcNamespace + "/" + blockedPvcName)
+	<-blocked
+	c.workqueue.Add("pvc/" + testPvcNamespace + "/" + testPvcName)
+
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+		return err == nil, nil
+	})
+	close(unblock)
+	if err != nil {
+		t.Errorf("Second PVC was not synced while the first one was blocked: %v", err)
+	}
+	c.workqueue.ShutDownWithDrain()
+}
+
+func TestSyncPvcPodMutator(t *testing.T) {
+	tests := []struct {
+		name           string
+		mutator        func(*v1.Pod, *v1.PersistentVolumeClaim, *unstructured.Unstructured) error
+		expectedResult error
+		expectPod      bool
+	}{
+		{
+			name: "Mutator customizes pod",
+			mutator: func(pod *v1.Pod, pvc *v1.PersistentVolumeClaim, u *unstructured.Unstructured) error {
+				pod.Spec.ServiceAccountName = "populator-sa"
+				pod.Spec.Tolerations = []v1.Toleration{{Key: "storage", Operator: v1.TolerationOpExists}}
+				pod.Spec.ImagePullSecrets = []v1.LocalObjectReference{{Name: "regcred"}}
+				pod.Spec.Containers[0].Env = []v1.EnvVar{{Name: "SOURCE", Value: u.GetName()}}
+				return nil
+			},
+			expectPod: true,
+		},
+		{
+			name: "Mutator fails",
+			mutator: func(pod *v1.Pod, pvc *v1.PersistentVolumeClaim, u *unstructured.Unstructured) error {
+				return errors.New("mutator failed")
+			},
+			expectedResult: errors.New("mutator failed"),
+		},
+		{
+			name: "Mutator renames pod",
+			mutator: func(pod *v1.Pod, pvc *v1.PersistentVolumeClaim, u *unstructured.Unstructured) error {
+				pod.Name = "renamed"
+				return nil
+			},
+			expectedResult: fmt.Errorf("pod mutator must not change the name or namespace of populator pod %s/%s", testVpWorkingNamespace, testPodName),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			c, _ := initSyncTest(t, claim, ust(), sc())
+			c.podMutator = test.mutator
+
+			result := syncTestPvc(c)
+			if !compareResult(test.expectedResult, result) {
+				t.Errorf("Expected result %v, got %v", test.expectedResult, result)
+			}
+
+			pod, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if !test.expectPod {
+				if err == nil {
+					t.Errorf("Expected no populator pod to be created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get pod failed: %v", err)
+			}
+			if pod.Spec.ServiceAccountName != "populator-sa" || len(pod.Spec.Tolerations) != 1 ||
+				len(pod.Spec.ImagePullSecrets) != 1 || len(pod.Spec.Containers[0].Env) != 1 {
+				t.Errorf("Populator pod was not customized: %+v", pod.Spec)
+			}
+			if pod.Spec.NodeName != testNodeName {
+				t.Errorf("Expected pod on node %s, got %s", testNodeName, pod.Spec.NodeName)
+			}
+		})
+	}
+}
+
+func TestSyncPvcDeleted(t *testing.T) {
+	finalizer := testPrefix + "/" + pvcFinalizerSuffix
+
+	tests := []struct {
+		name            string
+		started         bool
+		volumeName      string
+		expectCancelled bool
+	}{
+		{
+			name: "Not started",
+		},
+		{
+			name:            "Population in flight",
+			started:         true,
+			expectCancelled: true,
+		},
+		{
+			name:       "Population done",
+			started:    true,
+			volumeName: testPvName,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, test.volumeName,
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			now := metav1.Now()
+			claim.DeletionTimestamp = &now
+			objects := []runtime.Object{claim, ust(), sc()}
+			if test.started {
+				claim.Finalizers = append(claim.Finalizers, finalizer)
+				pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+				objects = append(objects, pod(v1.PodRunning), pvcPrime)
+			}
+			c, recorder := initSyncTest(t, objects...)
+			if test.started {
+				c.metrics.operationStart(claim.UID, c.metricLabels(claim))
+			}
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if _, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{}); err == nil {
+				t.Errorf("Expected no populator pod")
+			}
+			if _, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{}); err == nil {
+				t.Errorf("Expected no PVC'")
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if hasFinalizer(got, finalizer) {
+				t.Errorf("Expected finalizer to be removed, got %v", got.Finalizers)
+			}
+			expectEvents := 0
+			if test.expectCancelled {
+				expectEvents = 1
+			}
+			if n := countEvents(recorder, reasonPopulatorCancelled); n != expectEvents {
+				t.Errorf("Expected %d %s events, got %d", expectEvents, reasonPopulatorCancelled, n)
+			}
+			if n := len(c.metrics.cache); n != 0 {
+				t.Errorf("Expected no operations in flight, got %d", n)
+			}
+
+			var cancelled uint64
+			metricsFamilies, err := c.metrics.registry.Gather()
+			if err != nil {
+				t.Fatalf("Error fetching metrics: %v", err)
+			}
+			for _, mf := range metricsFamilies {
+				if mf.GetName() != "volume_populator_operation_seconds" {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					for _, label := range m.GetLabel() {
+						if label.GetName() == labelResult && label.GetValue() == "cancelled" {
+							cancelled += m.GetHistogram().GetSampleCount()
+						}
+					}
+				}
+			}
+			if test.expectCancelled != (cancelled == 1) {
+				t.Errorf("Expected cancelled operation %t, got %d", test.expectCancelled, cancelled)
+			}
+		})
+	}
+}
+
+func TestControllerRunStopsOnCancel(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	c.workers = 4
+	synced := func() bool { return true }
+	c.pvcSynced, c.pvSynced, c.podSynced, c.scSynced, c.referenceGrantSynced =
+		synced, synced, synced, synced, synced
+	for _, ds := range c.dataSources {
+		ds.synced = synced
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- c.run(ctx)
+	}()
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Controller did not stop after cancellation")
+	}
+	if !c.workqueue.ShuttingDown() {
+		t.Errorf("Expected workqueue to be shut down")
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	cfg := VolumePopulatorConfig{
+		// Nothing listens here, so the caches never sync
+		RestConfig:   &rest.Config{Host: "http://127.0.0.1:1"},
+		ImageName:    "test-image",
+		HttpEndpoint: "localhost:0",
+		MetricsPath:  "/metrics",
+		Namespace:    testVpWorkingNamespace,
+		Prefix:       testPrefix,
+		Gk:           schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind},
+		Gvr: schema.GroupVersionResource{
+			Group:    testApiGroup,
+			Version:  "v1alpha1",
+			Resource: "testdatasources",
+		},
+		PopulatorArgs: func(b bool, u *unstructured.Unstructured) ([]string, error) {
+			return nil, nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- Run(ctx, cfg)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run did not return after cancellation")
+	}
+}
+
+func TestHandleUnstructured(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	gk := schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}
+	key := "pvc/" + testPvcNamespace + "/" + testPvcName
+	c.addNotification(key, unstructuredObjType(gk), testPvcNamespace, testDataSourceName)
+
+	// A data source of another kind with the same name
+	c.handleUnstructured(schema.GroupKind{Group: testApiGroup, Kind: "Other"})(ust())
+	if n := c.workqueue.Len(); n != 0 {
+		t.Errorf("Expected no PVC to be queued, got %d", n)
+	}
+
+	c.handleUnstructured(gk)(ust())
+	if n := c.workqueue.Len(); n != 1 {
+		t.Errorf("Expected 1 PVC to be queued, got %d", n)
+	}
+}
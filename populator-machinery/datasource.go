@@ -0,0 +1,146 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DataSourceConfig describes one kind of data source served by the
+// controller.
+type DataSourceConfig struct {
+	// Gk is the group and kind of the data source.
+	Gk schema.GroupKind
+	// Gvr is the group, version and resource of the data source.
+	Gvr schema.GroupVersionResource
+	// ImageName is the image used for the populator pods of this kind.
+	// Defaults to VolumePopulatorConfig.ImageName.
+	ImageName string
+	// PopulatorArgs returns the args for the populator pod, given whether
+	// the volume is raw block and the data source object.
+	PopulatorArgs func(bool, *unstructured.Unstructured) ([]string, error)
+	// ProviderFunctionConfig, if set, populates volumes of this kind in
+	// process instead of running populator pods.
+	ProviderFunctionConfig *ProviderFunctionConfig
+}
+
+func (ds *DataSourceConfig) setDefaults(imageName string) {
+	if ds.ImageName == "" {
+		ds.ImageName = imageName
+	}
+	if ds.ProviderFunctionConfig != nil && ds.ProviderFunctionConfig.PollInterval == 0 {
+		ds.ProviderFunctionConfig.PollInterval = defaultProviderPollInterval
+	}
+}
+
+func (ds *DataSourceConfig) validate() error {
+	if ds.Gk.Kind == "" {
+		return fmt.Errorf("data source kind must be set")
+	}
+	if ds.Gvr.Version == "" || ds.Gvr.Resource == "" {
+		return fmt.Errorf("data source version and resource must be set")
+	}
+	if ds.Gk.Group != ds.Gvr.Group {
+		return fmt.Errorf("data source group %q does not match resource group %q", ds.Gk.Group, ds.Gvr.Group)
+	}
+	if provider := ds.ProviderFunctionConfig; provider != nil {
+		if provider.PopulateFn == nil || provider.PopulateCompleteFn == nil {
+			return fmt.Errorf("provider populate and populate complete functions must be set")
+		}
+		if provider.PollInterval < 0 {
+			return fmt.Errorf("provider poll interval must not be negative")
+		}
+		return nil
+	}
+	if ds.ImageName == "" {
+		return fmt.Errorf("image name must be set")
+	}
+	if ds.PopulatorArgs == nil {
+		return fmt.Errorf("populator args function must be set")
+	}
+	return nil
+}
+
+// dataSourceConfigs returns all data sources served by the controller: the
+// one set directly in the config, if any, followed by DataSources.
+func (cfg *VolumePopulatorConfig) dataSourceConfigs() []DataSourceConfig {
+	var sources []DataSourceConfig
+	if !cfg.Gk.Empty() || !cfg.Gvr.Empty() {
+		sources = append(sources, DataSourceConfig{
+			Gk:                     cfg.Gk,
+			Gvr:                    cfg.Gvr,
+			ImageName:              cfg.ImageName,
+			PopulatorArgs:          cfg.PopulatorArgs,
+			ProviderFunctionConfig: cfg.ProviderFunctionConfig,
+		})
+	}
+	return append(sources, cfg.DataSources...)
+}
+
+// dataSource is a kind of data source served by the controller.
+type dataSource struct {
+	gk            schema.GroupKind
+	gvr           schema.GroupVersionResource
+	imageName     string
+	populatorArgs func(bool, *unstructured.Unstructured) ([]string, error)
+	provider      *ProviderFunctionConfig
+	lister        dynamiclister.Lister
+	synced        cache.InformerSynced
+}
+
+// newDataSource returns the data source for dsc. The caller sets the lister
+// and synced function, if it has an informer.
+func newDataSource(dsc DataSourceConfig) *dataSource {
+	return &dataSource{
+		gk:            dsc.Gk,
+		gvr:           dsc.Gvr,
+		imageName:     dsc.ImageName,
+		populatorArgs: dsc.PopulatorArgs,
+		provider:      dsc.ProviderFunctionConfig,
+	}
+}
+
+// dataSourceGroupKind returns the group and kind a data source reference
+// points to.
+func dataSourceGroupKind(dataSourceRef *corev1.TypedObjectReference) schema.GroupKind {
+	apiGroup := ""
+	if dataSourceRef.APIGroup != nil {
+		apiGroup = *dataSourceRef.APIGroup
+	}
+	return schema.GroupKind{Group: apiGroup, Kind: dataSourceRef.Kind}
+}
+
+// dataSourceOf returns the data source of a PVC and the namespace it is in.
+// The data source is nil if the PVC has none, or one this controller doesn't
+// handle.
+func (c *controller) dataSourceOf(pvc *corev1.PersistentVolumeClaim) (*dataSource, string) {
+	dataSourceRef := pvc.Spec.DataSourceRef
+	if dataSourceRef == nil || dataSourceRef.Name == "" {
+		return nil, ""
+	}
+	namespace := pvc.Namespace
+	if dataSourceRef.Namespace != nil {
+		namespace = *dataSourceRef.Namespace
+	}
+	return c.dataSources[dataSourceGroupKind(dataSourceRef)], namespace
+}
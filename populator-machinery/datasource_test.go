@@ -0,0 +1,230 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testOtherDatasourceKind = "OtherDatasource"
+	testOtherImageName      = "other-image"
+)
+
+func TestValidateDataSources(t *testing.T) {
+	populatorArgs := func(b bool, u *unstructured.Unstructured) ([]string, error) {
+		return nil, nil
+	}
+	otherDataSource := func() DataSourceConfig {
+		return DataSourceConfig{
+			Gk: schema.GroupKind{Group: testApiGroup, Kind: testOtherDatasourceKind},
+			Gvr: schema.GroupVersionResource{
+				Group:    testApiGroup,
+				Version:  "v1alpha1",
+				Resource: "otherdatasources",
+			},
+			PopulatorArgs: populatorArgs,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     VolumePopulatorConfig
+		wantErr bool
+	}{
+		{
+			name: "Only additional data sources",
+			cfg: VolumePopulatorConfig{
+				ImageName:   "test-image",
+				DataSources: []DataSourceConfig{otherDataSource()},
+			},
+		},
+		{
+			name: "No data sources",
+			cfg: VolumePopulatorConfig{
+				ImageName: "test-image",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Duplicate data source",
+			cfg: VolumePopulatorConfig{
+				ImageName:   "test-image",
+				DataSources: []DataSourceConfig{otherDataSource(), otherDataSource()},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Missing image",
+			cfg: VolumePopulatorConfig{
+				DataSources: []DataSourceConfig{otherDataSource()},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			cfg.Namespace = testVpWorkingNamespace
+			cfg.Prefix = testPrefix
+			cfg.setDefaults()
+			err := cfg.validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Expected error %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSyncPvcMultipleDataSources(t *testing.T) {
+	otherGk := schema.GroupKind{Group: testApiGroup, Kind: testOtherDatasourceKind}
+	otherGvr := schema.GroupVersionResource{Group: testApiGroup, Version: "v1alpha1", Resource: "otherdatasources"}
+
+	tests := []struct {
+		name        string
+		kind        string
+		expectImage string
+		expectPod   bool
+	}{
+		{
+			name:      "Default data source",
+			kind:      testDatasourceKind,
+			expectPod: true,
+		},
+		{
+			name:        "Additional data source",
+			kind:        testOtherDatasourceKind,
+			expectImage: testOtherImageName,
+			expectPod:   true,
+		},
+		{
+			name: "Unknown data source",
+			kind: "UnknownDatasource",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, test.kind, testDataSourceName, testPvcNamespace), "")
+			c, _ := initSyncTest(t, claim, ust(), sc())
+			otherIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			var argsKind string
+			c.dataSources[otherGk] = &dataSource{
+				gk:        otherGk,
+				imageName: testOtherImageName,
+				populatorArgs: func(b bool, u *unstructured.Unstructured) ([]string, error) {
+					argsKind = u.GetKind()
+					return []string{"--other"}, nil
+				},
+				lister: dynamiclister.New(otherIndexer, otherGvr),
+				synced: func() bool { return true },
+			}
+			other := ust()
+			other.SetKind(testOtherDatasourceKind)
+			otherIndexer.Add(other)
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			pod, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if !test.expectPod {
+				if err == nil {
+					t.Errorf("Expected no populator pod to be created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get pod failed: %v", err)
+			}
+			if image := pod.Spec.Containers[0].Image; image != test.expectImage {
+				t.Errorf("Expected image %q, got %q", test.expectImage, image)
+			}
+			if test.kind == testOtherDatasourceKind {
+				if argsKind != testOtherDatasourceKind {
+					t.Errorf("Expected populator args for %s, got %q", testOtherDatasourceKind, argsKind)
+				}
+				if args := pod.Spec.Containers[0].Args; len(args) != 1 || args[0] != "--other" {
+					t.Errorf("Expected args of the additional data source, got %v", args)
+				}
+			} else if argsKind != "" {
+				t.Errorf("Expected populator args of the default data source, got %s", argsKind)
+			}
+		})
+	}
+}
+
+func TestDataSourceOf(t *testing.T) {
+	tests := []struct {
+		name            string
+		dataSourceRef   *corev1.TypedObjectReference
+		expectHandled   bool
+		expectNamespace string
+	}{
+		{
+			name: "No data source",
+		},
+		{
+			name:          "No name",
+			dataSourceRef: dsf(testApiGroup, testDatasourceKind, "", testPvcNamespace),
+		},
+		{
+			name:          "Other kind",
+			dataSourceRef: dsf(testApiGroup, testOtherDatasourceKind, testDataSourceName, testPvcNamespace),
+		},
+		{
+			name: "Same namespace",
+			dataSourceRef: func() *corev1.TypedObjectReference {
+				ref := dsf(testApiGroup, testDatasourceKind, testDataSourceName, "")
+				ref.Namespace = nil
+				return ref
+			}(),
+			expectHandled:   true,
+			expectNamespace: testPvcNamespace,
+		},
+		{
+			name:            "Other namespace",
+			dataSourceRef:   dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace),
+			expectHandled:   true,
+			expectNamespace: testDataSourceNamespace,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, _, _, _, _ := initTest()
+			claim := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", test.dataSourceRef, "")
+			ds, namespace := c.dataSourceOf(claim)
+			if (ds != nil) != test.expectHandled {
+				t.Fatalf("Expected handled %t, got data source %v", test.expectHandled, ds)
+			}
+			if test.expectHandled && namespace != test.expectNamespace {
+				t.Errorf("Expected namespace %q, got %q", test.expectNamespace, namespace)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWorkerStallTimeout = 5 * time.Minute
+)
+
+// namedCheck adapts a function to the healthChecker interface.
+type namedCheck struct {
+	name  string
+	check func(req *http.Request) error
+}
+
+func (n namedCheck) Name() string {
+	return n.name
+}
+
+func (n namedCheck) Check(req *http.Request) error {
+	return n.check(req)
+}
+
+// workerTracker records which workqueue keys are being synced and since when,
+// so that a worker stuck on one key can be detected.
+type workerTracker struct {
+	running    int32
+	mu         sync.Mutex
+	inProgress map[string]time.Time
+}
+
+func newWorkerTracker() *workerTracker {
+	return &workerTracker{inProgress: make(map[string]time.Time)}
+}
+
+func (w *workerTracker) workerStarted() {
+	atomic.AddInt32(&w.running, 1)
+}
+
+func (w *workerTracker) workerStopped() {
+	atomic.AddInt32(&w.running, -1)
+}
+
+func (w *workerTracker) runningWorkers() int {
+	return int(atomic.LoadInt32(&w.running))
+}
+
+func (w *workerTracker) syncStarted(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inProgress[key] = time.Now()
+}
+
+func (w *workerTracker) syncFinished(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.inProgress, key)
+}
+
+// stalled returns a key that has been syncing for longer than timeout, if any.
+func (w *workerTracker) stalled(timeout time.Duration) (string, time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, start := range w.inProgress {
+		if d := time.Since(start); d > timeout {
+			return key, d, true
+		}
+	}
+	return "", 0, false
+}
+
+// livenessCheck fails when a worker has been stuck on a single key for longer
+// than the stall timeout.
+func (c *controller) livenessCheck() healthChecker {
+	return namedCheck{
+		name: "workers",
+		check: func(_ *http.Request) error {
+			if key, d, ok := c.workerTracker.stalled(c.workerStallTimeout); ok {
+				return fmt.Errorf("worker stuck syncing %s for %s", key, d.Round(time.Second))
+			}
+			return nil
+		},
+	}
+}
+
+// readinessCheck fails until all informer caches have synced and all workers
+// are running. A replica that is waiting for leadership has not started the
+// controller yet and reports ready, so that rolling updates can proceed.
+func (c *controller) readinessCheck() healthChecker {
+	return namedCheck{
+		name: "controller",
+		check: func(_ *http.Request) error {
+			if atomic.LoadInt32(&c.started) == 0 {
+				return nil
+			}
+			for _, synced := range c.informersSynced() {
+				if !synced() {
+					return fmt.Errorf("informer caches not synced")
+				}
+			}
+			if running := c.workerTracker.runningWorkers(); running != c.workers {
+				return fmt.Errorf("%d of %d workers running", running, c.workers)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLivenessCheck(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	c.workerStallTimeout = 50 * time.Millisecond
+	check := c.livenessCheck()
+
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Expected idle workers to be healthy, got %v", err)
+	}
+
+	key := "pvc/" + testPvcNamespace + "/" + testPvcName
+	c.workerTracker.syncStarted(key)
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Expected a fresh sync to be healthy, got %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Expected a stuck sync to be unhealthy")
+	}
+
+	c.workerTracker.syncFinished(key)
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Expected workers to be healthy after the sync finished, got %v", err)
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	c.workers = 2
+	check := c.readinessCheck()
+
+	// Not started, e.g. waiting for leadership
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Expected a standby controller to be ready, got %v", err)
+	}
+
+	atomic.StoreInt32(&c.started, 1)
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Expected controller with unsynced informers to be not ready")
+	}
+
+	synced := func() bool { return true }
+	c.pvcSynced, c.pvSynced, c.podSynced, c.scSynced, c.referenceGrantSynced =
+		synced, synced, synced, synced, synced
+	for _, ds := range c.dataSources {
+		ds.synced = synced
+	}
+	c.workerTracker.workerStarted()
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Expected controller with missing workers to be not ready")
+	}
+
+	c.workerTracker.workerStarted()
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Expected controller to be ready, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 5 * time.Second
+
+	// leaderElectionHealthTimeout is how long the leader may fail to renew its
+	// lease past expiry before the health check reports failure.
+	leaderElectionHealthTimeout = 20 * time.Second
+)
+
+// LeaderElectionConfig configures Lease-based leader election for the
+// populator controller. Only the leader creates populator pods and rebinds PVs.
+type LeaderElectionConfig struct {
+	// Enabled turns on leader election.
+	Enabled bool
+	// Namespace holds the Lease object. Defaults to the populator namespace.
+	Namespace string
+	// LeaseName is the name of the Lease object. Defaults to
+	// "<prefix>-populator".
+	LeaseName string
+	// LeaseDuration is how long non-leaders wait before trying to take over
+	// an unrenewed lease. Defaults to 15s.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader retries renewing before giving up
+	// leadership. Defaults to 10s.
+	RenewDeadline time.Duration
+	// RetryPeriod is how long clients wait between attempts. Defaults to 5s.
+	RetryPeriod time.Duration
+}
+
+// runWithLeaderElection calls run once this instance becomes the leader and
+// returns when ctx is cancelled or leadership is lost.
+func runWithLeaderElection(ctx context.Context, kubeClient kubernetes.Interface, cfg LeaderElectionConfig,
+	watchdog *leaderelection.HealthzAdaptor, run func(context.Context) error,
+) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname for leader election identity: %v", err)
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, cfg.Namespace, cfg.LeaseName,
+		kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return fmt.Errorf("failed to create leader election lock: %v", err)
+	}
+
+	// The elector starts OnStartedLeading in its own goroutine and does not
+	// wait for it, so track it here to return only after run has finished.
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		finished bool
+		runErr   error
+	)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				mu.Lock()
+				if finished {
+					mu.Unlock()
+					return
+				}
+				wg.Add(1)
+				mu.Unlock()
+				defer wg.Done()
+				klog.Infof("Became leader for lease %s/%s, starting controller", cfg.Namespace, cfg.LeaseName)
+				runErr = run(ctx)
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("Stopped leading lease %s/%s", cfg.Namespace, cfg.LeaseName)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("Current leader for lease %s/%s is %s", cfg.Namespace, cfg.LeaseName, leader)
+				}
+			},
+		},
+		// The elector would release the lease as soon as ctx is cancelled,
+		// while our workers are still finishing their syncs. We release it
+		// ourselves once run has returned.
+		ReleaseOnCancel: false,
+		WatchDog:        watchdog,
+		Name:            cfg.LeaseName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create leader elector: %v", err)
+	}
+	if watchdog != nil {
+		watchdog.SetLeaderElection(elector)
+	}
+
+	elector.Run(ctx)
+
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+	wg.Wait()
+
+	releaseLease(lock, identity, cfg.RenewDeadline)
+
+	if runErr != nil {
+		return runErr
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost leader election for lease %s/%s", cfg.Namespace, cfg.LeaseName)
+	}
+	return nil
+}
+
+// releaseLease gives up the lease if this instance still holds it, so that
+// another replica can take over without waiting for the lease to expire.
+func releaseLease(lock resourcelock.Interface, identity string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	record, _, err := lock.Get(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get lease %s to release it: %v", lock.Describe(), err)
+		return
+	}
+	if record.HolderIdentity != identity {
+		return
+	}
+	now := metav1.NewTime(time.Now())
+	err = lock.Update(ctx, resourcelock.LeaderElectionRecord{
+		LeaderTransitions:    record.LeaderTransitions,
+		LeaseDurationSeconds: 1,
+		RenewTime:            now,
+		AcquireTime:          now,
+	})
+	if err != nil {
+		klog.Errorf("Failed to release lease %s: %v", lock.Describe(), err)
+		return
+	}
+	klog.Infof("Released lease %s", lock.Describe())
+}
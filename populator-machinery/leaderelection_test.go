@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+func testLeaderElectionConfig() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Enabled:       true,
+		Namespace:     testVpWorkingNamespace,
+		LeaseName:     testPrefix + "-" + controllerNameSuffix,
+		LeaseDuration: defaultLeaseDuration,
+		RenewDeadline: defaultRenewDeadline,
+		RetryPeriod:   defaultRetryPeriod,
+	}
+}
+
+func TestRunWithLeaderElection(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	cfg := testLeaderElectionConfig()
+	watchdog := leaderelection.NewLeaderHealthzAdaptor(leaderElectionHealthTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- runWithLeaderElection(ctx, kubeClient, cfg, watchdog, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			// The lease must be kept until the workers are done
+			lease, err := kubeClient.CoordinationV1().Leases(cfg.Namespace).Get(context.TODO(), cfg.LeaseName, metav1.GetOptions{})
+			if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+				t.Errorf("Expected lease to be held until the controller stopped, got %+v, %v", lease, err)
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Controller was not started after acquiring the lease")
+	}
+
+	lease, err := kubeClient.CoordinationV1().Leases(cfg.Namespace).Get(context.TODO(), cfg.LeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		t.Errorf("Expected lease to have a holder")
+	}
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected no error after cancellation, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Leader election did not stop after cancellation")
+	}
+
+	lease, err = kubeClient.CoordinationV1().Leases(cfg.Namespace).Get(context.TODO(), cfg.LeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		t.Errorf("Expected lease to be released, got holder %s", *lease.Spec.HolderIdentity)
+	}
+}
+
+func TestRunWithLeaderElectionHealthCheck(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	cfg := testLeaderElectionConfig()
+	cfg.LeaseDuration = time.Second
+	cfg.RenewDeadline = 500 * time.Millisecond
+	cfg.RetryPeriod = 100 * time.Millisecond
+	watchdog := leaderelection.NewLeaderHealthzAdaptor(100 * time.Millisecond)
+
+	started := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- runWithLeaderElection(context.Background(), kubeClient, cfg, watchdog, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Controller was not started after acquiring the lease")
+	}
+	if err := watchdog.Check(nil); err != nil {
+		t.Errorf("Expected leader election health check to pass while renewing, got %v", err)
+	}
+
+	// The leader can't renew its lease anymore
+	kubeClient.PrependReactor("update", "leases", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("apiserver unavailable")
+	})
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("Expected an error after losing the lease")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Leader election did not stop after failing to renew")
+	}
+
+	err := wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return watchdog.Check(nil) != nil, nil
+	})
+	if err != nil {
+		t.Errorf("Expected leader election health check to fail once renewal stopped past the timeout")
+	}
+}
+
+func TestRunWithLeaderElectionNotLeader(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	cfg := testLeaderElectionConfig()
+	holder := "other-replica"
+	now := metav1.NewMicroTime(time.Now())
+	leaseSeconds := int32(cfg.LeaseDuration.Seconds())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cfg.LeaseName,
+			Namespace: cfg.Namespace,
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &leaseSeconds,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	if _, err := kubeClient.CoordinationV1().Leases(cfg.Namespace).Create(context.TODO(), lease, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create lease: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := runWithLeaderElection(ctx, kubeClient, cfg, nil, func(ctx context.Context) error {
+		t.Errorf("Controller must not run while another replica holds the lease")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
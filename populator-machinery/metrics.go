@@ -18,8 +18,10 @@ package populator_machinery
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,28 +31,84 @@ import (
 )
 
 const (
-	subSystem   = "volume_populator"
-	labelResult = "result"
+	subSystem         = "volume_populator"
+	labelResult       = "result"
+	labelResource     = "resource"
+	labelGroup        = "group"
+	labelKind         = "kind"
+	labelStorageClass = "storage_class"
+	labelNamespace    = "namespace"
+	labelPVC          = "pvc"
+
+	resourcePod = "pod"
+	resourcePVC = "pvc"
 )
 
+// sourceLabels describe the data source and storage class of a population.
+// They are only added to the metrics if enabled in the config.
+type sourceLabels struct {
+	group        string
+	kind         string
+	storageClass string
+}
+
+type operation struct {
+	start  time.Time
+	labels sourceLabels
+	// progressLabels are set once the populator pod reported progress
+	progressLabels []string
+}
+
+// healthChecker is a named check served on the diagnostics server, both on
+// its own under /healthz/<name> or /readyz/<name> and as part of /healthz or
+// /readyz.
+type healthChecker interface {
+	Name() string
+	Check(req *http.Request) error
+}
+
 type metricsManager struct {
 	mu               sync.Mutex
 	srv              *http.Server
-	cache            map[types.UID]time.Time
+	healthChecks     []healthChecker
+	readyChecks      []healthChecker
+	stopCh           chan struct{}
+	serveErr         chan error
+	cache            map[types.UID]operation
+	withSourceLabels bool
 	registry         k8smetrics.KubeRegistry
 	opLatencyMetrics *k8smetrics.HistogramVec
 	opInFlight       *k8smetrics.Gauge
+	podFailures      *k8smetrics.CounterVec
+	retries          *k8smetrics.CounterVec
+	creationErrors   *k8smetrics.CounterVec
+	orphans          *k8smetrics.CounterVec
+	progress         *k8smetrics.GaugeVec
 }
 
 var metricBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60, 120, 300, 600}
 var inFlightCheckInterval = 30 * time.Second
 
 func initMetrics() *metricsManager {
+	return initMetricsWithSourceLabels(false)
+}
+
+// initMetricsWithSourceLabels creates the metrics, optionally labelled with
+// the data source group and kind and the storage class of each population.
+func initMetricsWithSourceLabels(withSourceLabels bool) *metricsManager {
 
 	m := new(metricsManager)
-	m.cache = make(map[types.UID]time.Time)
+	m.cache = make(map[types.UID]operation)
+	m.withSourceLabels = withSourceLabels
+	m.stopCh = make(chan struct{})
+	m.serveErr = make(chan error, 1)
 	m.registry = k8smetrics.NewKubeRegistry()
 
+	var extraLabels []string
+	if withSourceLabels {
+		extraLabels = []string{labelGroup, labelKind, labelStorageClass}
+	}
+
 	m.opLatencyMetrics = k8smetrics.NewHistogramVec(
 		&k8smetrics.HistogramOpts{
 			Subsystem: subSystem,
@@ -58,7 +116,7 @@ func initMetrics() *metricsManager {
 			Help:      "Time taken by each populator operation",
 			Buckets:   metricBuckets,
 		},
-		[]string{labelResult},
+		append([]string{labelResult}, extraLabels...),
 	)
 	m.opInFlight = k8smetrics.NewGauge(
 		&k8smetrics.GaugeOpts{
@@ -68,22 +126,74 @@ func initMetrics() *metricsManager {
 		},
 	)
 
+	m.podFailures = k8smetrics.NewCounterVec(
+		&k8smetrics.CounterOpts{
+			Subsystem: subSystem,
+			Name:      "pod_failures_total",
+			Help:      "Total number of failed populator pods",
+		},
+		extraLabels,
+	)
+	m.retries = k8smetrics.NewCounterVec(
+		&k8smetrics.CounterOpts{
+			Subsystem: subSystem,
+			Name:      "retries_total",
+			Help:      "Total number of populations retried after a failure",
+		},
+		extraLabels,
+	)
+	m.creationErrors = k8smetrics.NewCounterVec(
+		&k8smetrics.CounterOpts{
+			Subsystem: subSystem,
+			Name:      "creation_errors_total",
+			Help:      "Total number of errors creating populator pods and PVCs",
+		},
+		append([]string{labelResource}, extraLabels...),
+	)
+	m.orphans = k8smetrics.NewCounterVec(
+		&k8smetrics.CounterOpts{
+			Subsystem: subSystem,
+			Name:      "orphans_total",
+			Help:      "Total number of populator pods and PVCs found without their PVC",
+		},
+		[]string{labelResource, labelResult},
+	)
+
+	m.progress = k8smetrics.NewGaugeVec(
+		&k8smetrics.GaugeOpts{
+			Subsystem: subSystem,
+			Name:      "operation_progress_percent",
+			Help:      "Progress reported by the populator pod of each operation in flight",
+		},
+		[]string{labelNamespace, labelPVC},
+	)
+
 	k8smetrics.RegisterProcessStartTime(m.registry.Register)
 	m.registry.MustRegister(m.opLatencyMetrics)
 	m.registry.MustRegister(m.opInFlight)
-
-	go m.scheduleOpsInFlightMetric()
+	m.registry.MustRegister(m.podFailures)
+	m.registry.MustRegister(m.retries)
+	m.registry.MustRegister(m.creationErrors)
+	m.registry.MustRegister(m.orphans)
+	m.registry.MustRegister(m.progress)
 
 	return m
 }
 
-func (m *metricsManager) scheduleOpsInFlightMetric() {
-	for range time.Tick(inFlightCheckInterval) {
-		func() {
-			m.mu.Lock()
-			defer m.mu.Unlock()
-			m.opInFlight.Set(float64(len(m.cache)))
-		}()
+func (m *metricsManager) scheduleOpsInFlightMetric(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			func() {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				m.opInFlight.Set(float64(len(m.cache)))
+			}()
+		}
 	}
 }
 
@@ -93,35 +203,89 @@ func (pl promklog) Println(v ...interface{}) {
 	klog.Error(v...)
 }
 
-func (m *metricsManager) startListener(httpEndpoint, metricsPath string) {
-	if "" == httpEndpoint || "" == metricsPath {
-		return
+func (m *metricsManager) startListener(httpEndpoint, metricsPath string) error {
+	if "" == httpEndpoint {
+		return nil
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle(metricsPath, k8smetrics.HandlerFor(
-		m.registry,
-		k8smetrics.HandlerOpts{
-			ErrorLog:      promklog{},
-			ErrorHandling: k8smetrics.ContinueOnError,
-		}))
+	if "" != metricsPath {
+		mux.Handle(metricsPath, k8smetrics.HandlerFor(
+			m.registry,
+			k8smetrics.HandlerOpts{
+				ErrorLog:      promklog{},
+				ErrorHandling: k8smetrics.ContinueOnError,
+			}))
+
+		klog.Infof("Metrics path successfully registered at %s", metricsPath)
+	}
 
-	klog.Infof("Metrics path successfully registered at %s", metricsPath)
+	registerChecks(mux, "/healthz", m.healthChecks)
+	registerChecks(mux, "/readyz", m.readyChecks)
 
 	l, err := net.Listen("tcp", httpEndpoint)
 	if err != nil {
-		klog.Fatalf("failed to listen on address[%s], error[%v]", httpEndpoint, err)
+		return fmt.Errorf("failed to listen on address[%s], error[%v]", httpEndpoint, err)
 	}
 	m.srv = &http.Server{Addr: l.Addr().String(), Handler: mux}
 	go func() {
 		if err := m.srv.Serve(l); err != http.ErrServerClosed {
-			klog.Fatalf("failed to start endpoint at:%s/%s, error: %v", httpEndpoint, metricsPath, err)
+			klog.Errorf("failed to serve endpoint at:%s/%s, error: %v", httpEndpoint, metricsPath, err)
+			m.serveErr <- err
 		}
 	}()
+	// Only update the in-flight gauge while it can be scraped, so that
+	// nothing is left running if the listener can't be started
+	if "" != metricsPath {
+		go m.scheduleOpsInFlightMetric(inFlightCheckInterval)
+	}
 	klog.Infof("Metrics http server successfully started on %s, %s", httpEndpoint, metricsPath)
+	return nil
+}
+
+// addHealthCheck registers a liveness check to be served by startListener.
+func (m *metricsManager) addHealthCheck(hc healthChecker) {
+	m.healthChecks = append(m.healthChecks, hc)
+}
+
+// addReadyCheck registers a readiness check to be served by startListener.
+func (m *metricsManager) addReadyCheck(hc healthChecker) {
+	m.readyChecks = append(m.readyChecks, hc)
+}
+
+func registerChecks(mux *http.ServeMux, path string, checks []healthChecker) {
+	mux.Handle(path, healthCheckHandler(checks))
+	for _, hc := range checks {
+		mux.Handle(path+"/"+hc.Name(), healthCheckHandler([]healthChecker{hc}))
+	}
+	klog.Infof("Health checks successfully registered at %s", path)
+}
+
+func healthCheckHandler(checks []healthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var failed []string
+		for _, hc := range checks {
+			if err := hc.Check(r); err != nil {
+				klog.V(2).Infof("Health check %s failed: %v", hc.Name(), err)
+				failed = append(failed, fmt.Sprintf("%s check failed: %v", hc.Name(), err))
+			}
+		}
+		if len(failed) > 0 {
+			http.Error(w, strings.Join(failed, "\n"), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// serveErrors returns a channel that receives the error if the diagnostics
+// server stops serving before stopListener is called.
+func (m *metricsManager) serveErrors() <-chan error {
+	return m.serveErr
 }
 
 func (m *metricsManager) stopListener() {
+	close(m.stopCh)
 	if m.srv == nil {
 		return
 	}
@@ -134,13 +298,22 @@ func (m *metricsManager) stopListener() {
 	klog.Infof("Metrics server successfully shutdown")
 }
 
+// labelValues returns the given label values followed by the source labels,
+// if enabled.
+func (m *metricsManager) labelValues(labels sourceLabels, values ...string) []string {
+	if m.withSourceLabels {
+		values = append(values, labels.group, labels.kind, labels.storageClass)
+	}
+	return values
+}
+
 // operationStart starts a new operation
-func (m *metricsManager) operationStart(pvcUID types.UID) {
+func (m *metricsManager) operationStart(pvcUID types.UID, labels sourceLabels) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if _, exists := m.cache[pvcUID]; !exists {
-		m.cache[pvcUID] = time.Now()
+		m.cache[pvcUID] = operation{start: time.Now(), labels: labels}
 	}
 	m.opInFlight.Set(float64(len(m.cache)))
 }
@@ -149,6 +322,7 @@ func (m *metricsManager) operationStart(pvcUID types.UID) {
 func (m *metricsManager) dropOperation(pvcUID types.UID) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.deleteProgress(pvcUID)
 	delete(m.cache, pvcUID)
 	m.opInFlight.Set(float64(len(m.cache)))
 }
@@ -157,15 +331,68 @@ func (m *metricsManager) dropOperation(pvcUID types.UID) {
 func (m *metricsManager) recordMetrics(pvcUID types.UID, result string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	startTime, exists := m.cache[pvcUID]
+	op, exists := m.cache[pvcUID]
 	if !exists {
 		// the operation has not been cached, return directly
 		return
 	}
 
-	operationDuration := time.Since(startTime).Seconds()
-	m.opLatencyMetrics.WithLabelValues(result).Observe(operationDuration)
+	operationDuration := time.Since(op.start).Seconds()
+	m.opLatencyMetrics.WithLabelValues(m.labelValues(op.labels, result)...).Observe(operationDuration)
 
+	m.deleteProgress(pvcUID)
 	delete(m.cache, pvcUID)
 	m.opInFlight.Set(float64(len(m.cache)))
 }
+
+// recordPodFailure counts a failed populator pod
+func (m *metricsManager) recordPodFailure(labels sourceLabels) {
+	m.podFailures.WithLabelValues(m.labelValues(labels)...).Inc()
+}
+
+// recordRetry counts a population that is retried after a failure
+func (m *metricsManager) recordRetry(labels sourceLabels) {
+	m.retries.WithLabelValues(m.labelValues(labels)...).Inc()
+}
+
+// recordCreationError counts a failure to create a populator pod or PVC
+func (m *metricsManager) recordCreationError(resource string, labels sourceLabels) {
+	m.creationErrors.WithLabelValues(m.labelValues(labels, resource)...).Inc()
+}
+
+// recordOrphan counts a populator pod or PVC found without its PVC
+func (m *metricsManager) recordOrphan(resource, result string) {
+	m.orphans.WithLabelValues(resource, result).Inc()
+}
+
+// recordProgress sets the progress of an operation in flight
+func (m *metricsManager) recordProgress(pvcUID types.UID, namespace, name string, percent int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, exists := m.cache[pvcUID]
+	if !exists {
+		return
+	}
+	op.progressLabels = []string{namespace, name}
+	m.cache[pvcUID] = op
+	m.progress.WithLabelValues(op.progressLabels...).Set(float64(percent))
+}
+
+// clearProgress removes the progress of an operation in flight, whose next
+// attempt starts from scratch
+func (m *metricsManager) clearProgress(pvcUID types.UID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteProgress(pvcUID)
+	if op, exists := m.cache[pvcUID]; exists {
+		op.progressLabels = nil
+		m.cache[pvcUID] = op
+	}
+}
+
+// deleteProgress removes the progress of an operation. Callers must hold m.mu.
+func (m *metricsManager) deleteProgress(pvcUID types.UID) {
+	if op, exists := m.cache[pvcUID]; exists && op.progressLabels != nil {
+		m.progress.DeleteLabelValues(op.progressLabels...)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
@@ -55,7 +56,7 @@ func TestRecordMetrics(t *testing.T) {
 	srvAddr := "http://" + mgr.srv.Addr + httpPattern
 	defer mgr.stopListener()
 	pvcUID := types.UID("uid1")
-	mgr.operationStart(pvcUID)
+	mgr.operationStart(pvcUID, sourceLabels{})
 	time.Sleep(1100 * time.Millisecond)
 	mgr.recordMetrics(pvcUID, "result1")
 
@@ -99,7 +100,7 @@ func TestInFlightMetric(t *testing.T) {
 	srvAddr := "http://" + mgr.srv.Addr + httpPattern
 
 	pvcUID1 := types.UID("uid1")
-	mgr.operationStart(pvcUID1)
+	mgr.operationStart(pvcUID1, sourceLabels{})
 	time.Sleep(500 * time.Millisecond)
 
 	if err := verifyInFlightMetric(`volume_populator_operations_in_flight 1`, srvAddr); err != nil {
@@ -107,7 +108,7 @@ func TestInFlightMetric(t *testing.T) {
 	}
 
 	pvcUID2 := types.UID("uid2")
-	mgr.operationStart(pvcUID2)
+	mgr.operationStart(pvcUID2, sourceLabels{})
 	time.Sleep(500 * time.Millisecond)
 
 	if err := verifyInFlightMetric(`volume_populator_operations_in_flight 2`, srvAddr); err != nil {
@@ -125,7 +126,7 @@ func TestInFlightMetric(t *testing.T) {
 	//  Start 50 operations, should be 51
 	for i := 0; i < 50; i++ {
 		pvcUID := types.UID(fmt.Sprintf("uid%d", 3+i))
-		mgr.operationStart(pvcUID)
+		mgr.operationStart(pvcUID, sourceLabels{})
 	}
 	time.Sleep(500 * time.Millisecond)
 
@@ -336,3 +337,191 @@ func TestProcessStartTimeMetricExist(t *testing.T) {
 
 	t.Fatalf("Metrics does not contain %v. Scraped content: %v", processStartTimeMetric, metricsFamilies)
 }
+
+type fakeHealthChecker struct {
+	err error
+}
+
+func (f *fakeHealthChecker) Name() string {
+	return "fake"
+}
+
+func (f *fakeHealthChecker) Check(_ *http.Request) error {
+	return f.err
+}
+
+func checkStatus(t *testing.T, url string, want int) {
+	t.Helper()
+	rsp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", url, err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != want {
+		t.Errorf("Expected status %d for %s, got %d", want, url, rsp.StatusCode)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	hc := &fakeHealthChecker{}
+	rc := &fakeHealthChecker{}
+	mgr := initMetrics()
+	mgr.addHealthCheck(hc)
+	mgr.addReadyCheck(rc)
+	if err := mgr.startListener(addr, httpPattern); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer mgr.stopListener()
+	srvAddr := "http://" + mgr.srv.Addr
+
+	checkStatus(t, srvAddr+"/healthz", http.StatusOK)
+	checkStatus(t, srvAddr+"/healthz/fake", http.StatusOK)
+	checkStatus(t, srvAddr+"/readyz", http.StatusOK)
+
+	hc.err = fmt.Errorf("unhealthy")
+	checkStatus(t, srvAddr+"/healthz", http.StatusInternalServerError)
+	checkStatus(t, srvAddr+"/healthz/fake", http.StatusInternalServerError)
+	checkStatus(t, srvAddr+"/readyz", http.StatusOK)
+
+	rc.err = fmt.Errorf("not ready")
+	checkStatus(t, srvAddr+"/readyz", http.StatusInternalServerError)
+	checkStatus(t, srvAddr+"/readyz/fake", http.StatusInternalServerError)
+}
+
+func TestHealthCheckWithoutMetrics(t *testing.T) {
+	mgr := initMetrics()
+	mgr.addHealthCheck(&fakeHealthChecker{})
+	if err := mgr.startListener(addr, ""); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer mgr.stopListener()
+	srvAddr := "http://" + mgr.srv.Addr
+
+	checkStatus(t, srvAddr+"/healthz", http.StatusOK)
+	checkStatus(t, srvAddr+"/readyz", http.StatusOK)
+	checkStatus(t, srvAddr+httpPattern, http.StatusNotFound)
+}
+
+func TestStartListenerFailure(t *testing.T) {
+	used := initMgr()
+	defer used.stopListener()
+
+	goroutines := runtime.NumGoroutine()
+	mgr := initMetrics()
+	if err := mgr.startListener(used.srv.Addr, httpPattern); err == nil {
+		mgr.stopListener()
+		t.Fatalf("Expected an error for an address in use")
+	}
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("Expected %d goroutines after a failed start, got %d", goroutines, n)
+	}
+}
+
+func TestFailureMetrics(t *testing.T) {
+	mgr := initMetricsWithSourceLabels(true)
+	if err := mgr.startListener(addr, httpPattern); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer mgr.stopListener()
+	srvAddr := "http://" + mgr.srv.Addr + httpPattern
+
+	labels := sourceLabels{group: "test.group", kind: "TestKind", storageClass: "test-sc"}
+	pvcUID := types.UID("uid1")
+	mgr.operationStart(pvcUID, labels)
+	mgr.recordPodFailure(labels)
+	mgr.recordRetry(labels)
+	mgr.recordPodFailure(labels)
+	mgr.recordCreationError(resourcePod, labels)
+	mgr.recordOrphan(resourcePVC, orphanDeleted)
+	mgr.recordMetrics(pvcUID, "failed")
+
+	expected :=
+		`# HELP process_start_time_seconds [ALPHA] Start time of the process since unix epoch in seconds.
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 0
+# HELP volume_populator_operation_seconds [ALPHA] Time taken by each populator operation
+# TYPE volume_populator_operation_seconds histogram
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="0.1"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="0.25"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="0.5"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="1"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="2.5"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="5"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="10"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="15"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="30"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="60"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="120"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="300"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="600"} 1
+volume_populator_operation_seconds_bucket{group="test.group",kind="TestKind",result="failed",storage_class="test-sc",le="+Inf"} 1
+volume_populator_operation_seconds_sum{group="test.group",kind="TestKind",result="failed",storage_class="test-sc"} 0
+volume_populator_operation_seconds_count{group="test.group",kind="TestKind",result="failed",storage_class="test-sc"} 1
+# HELP volume_populator_operations_in_flight [ALPHA] Total number of operations in flight
+# TYPE volume_populator_operations_in_flight gauge
+volume_populator_operations_in_flight 0
+# HELP volume_populator_pod_failures_total [ALPHA] Total number of failed populator pods
+# TYPE volume_populator_pod_failures_total counter
+volume_populator_pod_failures_total{group="test.group",kind="TestKind",storage_class="test-sc"} 2
+# HELP volume_populator_retries_total [ALPHA] Total number of populations retried after a failure
+# TYPE volume_populator_retries_total counter
+volume_populator_retries_total{group="test.group",kind="TestKind",storage_class="test-sc"} 1
+# HELP volume_populator_creation_errors_total [ALPHA] Total number of errors creating populator pods and PVCs
+# TYPE volume_populator_creation_errors_total counter
+volume_populator_creation_errors_total{group="test.group",kind="TestKind",resource="pod",storage_class="test-sc"} 1
+# HELP volume_populator_orphans_total [ALPHA] Total number of populator pods and PVCs found without their PVC
+# TYPE volume_populator_orphans_total counter
+volume_populator_orphans_total{resource="pvc",result="deleted"} 1
+`
+
+	if err := verifyMetric(expected, srvAddr); err != nil {
+		t.Errorf("failed testing [%v]", err)
+	}
+
+	counters := map[string]float64{
+		"volume_populator_pod_failures_total":    2,
+		"volume_populator_retries_total":         1,
+		"volume_populator_creation_errors_total": 1,
+		"volume_populator_orphans_total":         1,
+	}
+	metricsFamilies, err := mgr.registry.Gather()
+	if err != nil {
+		t.Fatalf("Error fetching metrics: %v", err)
+	}
+	for _, mf := range metricsFamilies {
+		want, ok := counters[mf.GetName()]
+		if !ok {
+			continue
+		}
+		delete(counters, mf.GetName())
+		if got := mf.GetMetric()[0].GetCounter().GetValue(); got != want {
+			t.Errorf("Expected %s to be %v, got %v", mf.GetName(), want, got)
+		}
+	}
+	for name := range counters {
+		t.Errorf("Metric %s not found", name)
+	}
+}
+
+func TestFailureMetricsWithoutSourceLabels(t *testing.T) {
+	mgr := initMetrics()
+	defer mgr.stopListener()
+
+	labels := sourceLabels{group: "test.group", kind: "TestKind", storageClass: "test-sc"}
+	mgr.recordPodFailure(labels)
+	mgr.recordCreationError(resourcePVC, labels)
+
+	metricsFamilies, err := mgr.registry.Gather()
+	if err != nil {
+		t.Fatalf("Error fetching metrics: %v", err)
+	}
+	for _, mf := range metricsFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == labelGroup || l.GetName() == labelKind || l.GetName() == labelStorageClass {
+					t.Errorf("Unexpected label %s on %s", l.GetName(), mf.GetName())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	populateProgressAnnoSuffix = "populate-progress"
+
+	// Populator pods get their own name and namespace through these
+	// environment variables, so that they can report progress.
+	podNameEnv      = "POD_NAME"
+	podNamespaceEnv = "POD_NAMESPACE"
+
+	// progressEventStep is the percentage step at which progress events are
+	// recorded on the PVC.
+	progressEventStep = 10
+)
+
+// Progress is the progress of a population, as reported by the populator pod.
+type Progress struct {
+	// Percent is the completion percentage, from 0 to 100.
+	Percent int `json:"percent"`
+	// BytesWritten is the number of bytes written to the volume so far.
+	BytesWritten int64 `json:"bytesWritten,omitempty"`
+}
+
+// ReportProgress is called from inside a populator pod to report its
+// progress. It annotates the pod, which the controller picks up and surfaces
+// on the PVC being populated. prefix must be the same prefix the controller
+// was started with. The pod's service account needs permission to patch pods
+// in the populator namespace.
+func ReportProgress(ctx context.Context, kubeClient kubernetes.Interface, prefix string, progress Progress) error {
+	name, namespace := os.Getenv(podNameEnv), os.Getenv(podNamespaceEnv)
+	if name == "" || namespace == "" {
+		return fmt.Errorf("%s and %s must be set to report progress", podNameEnv, podNamespaceEnv)
+	}
+	if progress.Percent < 0 || progress.Percent > 100 {
+		return fmt.Errorf("invalid progress percentage %d", progress.Percent)
+	}
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				prefix + "/" + populateProgressAnnoSuffix: string(value),
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+func parseProgress(value string) (Progress, error) {
+	var progress Progress
+	err := json.Unmarshal([]byte(value), &progress)
+	return progress, err
+}
+
+// updateProgress copies the progress reported by the populator pod to the PVC,
+// records an event every progressEventStep percent and updates the metric.
+func (c *controller) updateProgress(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pod *corev1.Pod) error {
+	value, ok := pod.Annotations[c.progressAnno]
+	if !ok || value == pvc.Annotations[c.progressAnno] {
+		return nil
+	}
+	progress, err := parseProgress(value)
+	if err != nil {
+		// Don't retry, the pod has to report again
+		klog.V(2).Infof("Ignoring invalid progress %q of pod %s/%s: %v", value, pod.Namespace, pod.Name, err)
+		return nil
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				c.progressAnno: value,
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	var previous Progress
+	if old, ok := pvc.Annotations[c.progressAnno]; ok {
+		previous, _ = parseProgress(old)
+	}
+	if progress.Percent/progressEventStep > previous.Percent/progressEventStep {
+		c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPopulatorProgress, "Populator progress: %d%%, %d bytes written",
+			progress.Percent, progress.BytesWritten)
+	}
+	c.metrics.recordProgress(pvc.UID, pvc.Namespace, pvc.Name, progress.Percent)
+	return nil
+}
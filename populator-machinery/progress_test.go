@@ -0,0 +1,224 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReportProgress(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(pod(corev1.PodRunning))
+	progressAnno := testPrefix + "/" + populateProgressAnnoSuffix
+
+	if err := ReportProgress(context.TODO(), kubeClient, testPrefix, Progress{Percent: 10}); err == nil {
+		t.Errorf("Expected error without pod name and namespace")
+	}
+
+	t.Setenv(podNameEnv, testPodName)
+	t.Setenv(podNamespaceEnv, testVpWorkingNamespace)
+	if err := ReportProgress(context.TODO(), kubeClient, testPrefix, Progress{Percent: 101}); err == nil {
+		t.Errorf("Expected error for invalid percentage")
+	}
+	if err := ReportProgress(context.TODO(), kubeClient, testPrefix, Progress{Percent: 42, BytesWritten: 1024}); err != nil {
+		t.Fatalf("Failed to report progress: %v", err)
+	}
+
+	got, err := kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pod failed: %v", err)
+	}
+	expected := `{"percent":42,"bytesWritten":1024}`
+	if value := got.Annotations[progressAnno]; value != expected {
+		t.Errorf("Expected progress annotation %s, got %s", expected, value)
+	}
+}
+
+func TestUpdateProgress(t *testing.T) {
+	progressAnno := testPrefix + "/" + populateProgressAnnoSuffix
+	tests := []struct {
+		name             string
+		pvcProgress      string
+		podProgress      string
+		expectedProgress string
+		expectEvent      bool
+	}{
+		{
+			name:             "No progress reported",
+			expectedProgress: "",
+		},
+		{
+			name:             "First progress",
+			podProgress:      `{"percent":15,"bytesWritten":100}`,
+			expectedProgress: `{"percent":15,"bytesWritten":100}`,
+			expectEvent:      true,
+		},
+		{
+			name:             "Progress within the same step",
+			pvcProgress:      `{"percent":15,"bytesWritten":100}`,
+			podProgress:      `{"percent":18,"bytesWritten":120}`,
+			expectedProgress: `{"percent":18,"bytesWritten":120}`,
+		},
+		{
+			name:             "Unchanged progress",
+			pvcProgress:      `{"percent":18}`,
+			podProgress:      `{"percent":18}`,
+			expectedProgress: `{"percent":18}`,
+		},
+		{
+			name:             "Invalid progress",
+			pvcProgress:      `{"percent":18}`,
+			podProgress:      `18%`,
+			expectedProgress: `{"percent":18}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, _, _, _, _ := initTest()
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			if test.pvcProgress != "" {
+				claim.Annotations[progressAnno] = test.pvcProgress
+			}
+			if _, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Create(context.TODO(), claim, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("Create pvc failed: %v", err)
+			}
+			p := pod(corev1.PodRunning)
+			if test.podProgress != "" {
+				p.Annotations = map[string]string{progressAnno: test.podProgress}
+			}
+			c.metrics.operationStart(claim.UID, sourceLabels{})
+
+			if err := c.updateProgress(context.TODO(), claim, p); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if value := got.Annotations[progressAnno]; value != test.expectedProgress {
+				t.Errorf("Expected progress %q, got %q", test.expectedProgress, value)
+			}
+			if n := countEvents(recorder, reasonPopulatorProgress); (n > 0) != test.expectEvent {
+				t.Errorf("Expected event %t, got %d events", test.expectEvent, n)
+			}
+		})
+	}
+}
+
+func TestProgressMetric(t *testing.T) {
+	mgr := initMetrics()
+	defer mgr.stopListener()
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "", nil, "")
+
+	countProgress := func() int {
+		metricsFamilies, err := mgr.registry.Gather()
+		if err != nil {
+			t.Fatalf("Error fetching metrics: %v", err)
+		}
+		for _, mf := range metricsFamilies {
+			if mf.GetName() == "volume_populator_operation_progress_percent" {
+				return len(mf.GetMetric())
+			}
+		}
+		return 0
+	}
+
+	// Progress of unknown operations is ignored
+	mgr.recordProgress(claim.UID, claim.Namespace, claim.Name, 50)
+	if n := countProgress(); n != 0 {
+		t.Errorf("Expected no progress metric, got %d", n)
+	}
+
+	mgr.operationStart(claim.UID, sourceLabels{})
+	mgr.recordProgress(claim.UID, claim.Namespace, claim.Name, 50)
+	if n := countProgress(); n != 1 {
+		t.Errorf("Expected 1 progress metric, got %d", n)
+	}
+
+	// A retry starts from scratch
+	mgr.clearProgress(claim.UID)
+	if n := countProgress(); n != 0 {
+		t.Errorf("Expected progress metric to be removed on retry, got %d", n)
+	}
+
+	for _, end := range []func(){
+		func() { mgr.recordMetrics(claim.UID, "success") },
+		func() { mgr.recordMetrics(claim.UID, "failed") },
+		func() { mgr.recordMetrics(claim.UID, "cancelled") },
+		func() { mgr.dropOperation(claim.UID) },
+	} {
+		mgr.operationStart(claim.UID, sourceLabels{})
+		mgr.recordProgress(claim.UID, claim.Namespace, claim.Name, 50)
+		end()
+		if n := countProgress(); n != 0 {
+			t.Errorf("Expected progress metric to be removed, got %d", n)
+		}
+	}
+}
+
+func TestSyncPvcProgressCleared(t *testing.T) {
+	progressAnno := testPrefix + "/" + populateProgressAnnoSuffix
+
+	tests := []struct {
+		name     string
+		podPhase corev1.PodPhase
+		pvcPrime *corev1.PersistentVolumeClaim
+	}{
+		{
+			name:     "Retry",
+			podPhase: corev1.PodFailed,
+			pvcPrime: pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, ""),
+		},
+		{
+			name:     "Success",
+			podPhase: corev1.PodSucceeded,
+			pvcPrime: pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimLost),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := populatingPvc()
+			claim.Annotations[progressAnno] = `{"percent":60}`
+			c, _ := initSyncTest(t, claim, test.pvcPrime, pod(test.podPhase), ust(), sc(),
+				pv(testPvcName, testPvcNamespace, testPvcUid))
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if value, ok := got.Annotations[progressAnno]; ok {
+				t.Errorf("Expected progress to be removed, got %q", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// PropagateAll copies all labels or annotations of a PVC to PVC'.
+	PropagateAll = "*"
+
+	managedByLabel             = "app.kubernetes.io/managed-by"
+	pvcNamespaceLabelSuffix    = "pvc-namespace"
+	pvcNameLabelSuffix         = "pvc-name"
+	pvcUIDLabelSuffix          = "pvc-uid"
+	dataSourceKindLabelSuffix  = "data-source-kind"
+	dataSourceGroupLabelSuffix = "data-source-group"
+)
+
+// PvcPrimeConfig controls what is copied from the PVC being populated to its
+// PVC'. By default PVC' only gets the access modes, resources, storage class
+// and volume mode of the PVC.
+type PvcPrimeConfig struct {
+	// Labels are the keys of the PVC labels copied to PVC'. PropagateAll
+	// copies all of them.
+	Labels []string
+	// Annotations are the keys of the PVC annotations copied to PVC'.
+	// PropagateAll copies all of them, except the ones in the kubernetes.io
+	// and k8s.io domains. Annotations with the controller prefix are never
+	// copied.
+	Annotations []string
+	// Mutator, if set, is called on every PVC' before it is created, with
+	// the PVC being populated. It can copy further fields, such as the
+	// selector or the volume attributes class on clusters that support it,
+	// but must not change the name or namespace of PVC'.
+	Mutator func(pvcPrime, pvc *corev1.PersistentVolumeClaim) error
+}
+
+func (p *PvcPrimeConfig) validate() error {
+	for _, key := range p.Labels {
+		if key == PropagateAll {
+			continue
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	for _, key := range p.Annotations {
+		if key == PropagateAll {
+			continue
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// artifactLabels returns the labels of the populator pod and PVC' of a PVC,
+// so they can be found by the PVC and data source they belong to. Values that
+// aren't valid label values, like long PVC names, are left out.
+func (c *controller) artifactLabels(pvc *corev1.PersistentVolumeClaim, ds *dataSource) map[string]string {
+	labels := map[string]string{
+		managedByLabel: c.prefix + "-" + controllerNameSuffix,
+	}
+	values := map[string]string{
+		pvcNamespaceLabelSuffix:    pvc.Namespace,
+		pvcNameLabelSuffix:         pvc.Name,
+		pvcUIDLabelSuffix:          string(pvc.UID),
+		dataSourceKindLabelSuffix:  ds.gk.Kind,
+		dataSourceGroupLabelSuffix: ds.gk.Group,
+	}
+	for suffix, value := range values {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			labels[c.prefix+"/"+suffix] = value
+		}
+	}
+	return labels
+}
+
+// pvcPrimeLabels returns the labels of PVC': the configured PVC labels and
+// the artifact labels, which take precedence.
+func (c *controller) pvcPrimeLabels(pvc *corev1.PersistentVolumeClaim, ds *dataSource) map[string]string {
+	labels := c.propagate(pvc.Labels, c.pvcPrime.Labels, nil)
+	for key, value := range c.artifactLabels(pvc, ds) {
+		labels[key] = value
+	}
+	return labels
+}
+
+// pvcPrimeAnnotations returns the configured PVC annotations, merged with the
+// given annotations of PVC', which take precedence.
+func (c *controller) pvcPrimeAnnotations(pvc *corev1.PersistentVolumeClaim, annotations map[string]string) map[string]string {
+	propagated := c.propagate(pvc.Annotations, c.pvcPrime.Annotations, reservedAnnotation)
+	for key, value := range annotations {
+		propagated[key] = value
+	}
+	return propagated
+}
+
+// reservedAnnotation returns true for annotations that are only copied if
+// they are listed explicitly, because Kubernetes sets them on the PVC.
+func reservedAnnotation(key string) bool {
+	domain, _, found := strings.Cut(key, "/")
+	if !found {
+		return false
+	}
+	for _, reserved := range []string{"kubernetes.io", "k8s.io"} {
+		if domain == reserved || strings.HasSuffix(domain, "."+reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// propagate returns the entries of from with the given keys, or all entries
+// that aren't reserved if keys contains PropagateAll. Keys with the controller
+// prefix are never propagated.
+func (c *controller) propagate(from map[string]string, keys []string, reserved func(string) bool) map[string]string {
+	to := map[string]string{}
+	for _, key := range keys {
+		if key == PropagateAll {
+			for k, v := range from {
+				if reserved == nil || !reserved(k) {
+					to[k] = v
+				}
+			}
+			continue
+		}
+		if value, ok := from[key]; ok {
+			to[key] = value
+		}
+	}
+	for key := range to {
+		if strings.HasPrefix(key, c.prefix+"/") {
+			delete(to, key)
+		}
+	}
+	return to
+}
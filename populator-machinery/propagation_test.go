@@ -0,0 +1,230 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPvcPrimeMetadata(t *testing.T) {
+	claimLabels := map[string]string{
+		"app":                    "db",
+		"team":                   "storage",
+		testPrefix + "/foo":      "bar",
+		"app.kubernetes.io/name": "db",
+	}
+	claimAnnotations := map[string]string{
+		"example.com/owner":                        "alice",
+		"example.com/cost-center":                  "42",
+		"pv.kubernetes.io/bind-completed":          "yes",
+		"volume.kubernetes.io/storage-provisioner": "test.csi.k8s.io",
+		testPrefix + "/" + requiredSizeAnnoSuffix:  "2Gi",
+	}
+
+	tests := []struct {
+		name                string
+		labels              []string
+		annotations         []string
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:                "Nothing propagated",
+			expectedLabels:      map[string]string{},
+			expectedAnnotations: map[string]string{},
+		},
+		{
+			name:        "Selected keys",
+			labels:      []string{"app", "missing"},
+			annotations: []string{"example.com/owner", "pv.kubernetes.io/bind-completed"},
+			expectedLabels: map[string]string{
+				"app": "db",
+			},
+			expectedAnnotations: map[string]string{
+				"example.com/owner":               "alice",
+				"pv.kubernetes.io/bind-completed": "yes",
+			},
+		},
+		{
+			name:        "All",
+			labels:      []string{PropagateAll},
+			annotations: []string{PropagateAll},
+			expectedLabels: map[string]string{
+				"app":                    "db",
+				"team":                   "storage",
+				"app.kubernetes.io/name": "db",
+			},
+			expectedAnnotations: map[string]string{
+				"example.com/owner":       "alice",
+				"example.com/cost-center": "42",
+			},
+		},
+		{
+			name:                "Controller keys",
+			labels:              []string{testPrefix + "/foo"},
+			annotations:         []string{testPrefix + "/" + requiredSizeAnnoSuffix},
+			expectedLabels:      map[string]string{},
+			expectedAnnotations: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, _, _, _, _ := initTest()
+			c.pvcPrime = PvcPrimeConfig{Labels: test.labels, Annotations: test.annotations}
+			ds := c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}]
+			claim := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", nil, "")
+			claim.Labels = claimLabels
+			claim.Annotations = claimAnnotations
+
+			labels := c.pvcPrimeLabels(claim, ds)
+			for key, value := range c.artifactLabels(claim, ds) {
+				test.expectedLabels[key] = value
+			}
+			if !reflect.DeepEqual(labels, test.expectedLabels) {
+				t.Errorf("Expected labels %v, got %v", test.expectedLabels, labels)
+			}
+			annotations := c.pvcPrimeAnnotations(claim, nil)
+			if !reflect.DeepEqual(annotations, test.expectedAnnotations) {
+				t.Errorf("Expected annotations %v, got %v", test.expectedAnnotations, annotations)
+			}
+		})
+	}
+}
+
+func TestArtifactLabels(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	ds := c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}]
+
+	claim := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", nil, "")
+	claim.UID = types.UID(testPvcUid)
+	expected := map[string]string{
+		managedByLabel: testPrefix + "-" + controllerNameSuffix,
+		testPrefix + "/" + pvcNamespaceLabelSuffix:    testPvcNamespace,
+		testPrefix + "/" + pvcNameLabelSuffix:         testPvcName,
+		testPrefix + "/" + pvcUIDLabelSuffix:          testPvcUid,
+		testPrefix + "/" + dataSourceKindLabelSuffix:  testDatasourceKind,
+		testPrefix + "/" + dataSourceGroupLabelSuffix: testApiGroup,
+	}
+	if labels := c.artifactLabels(claim, ds); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, labels)
+	}
+
+	// Names longer than 63 characters aren't valid label values
+	claim.Name = strings.Repeat("a", 100)
+	delete(expected, testPrefix+"/"+pvcNameLabelSuffix)
+	if labels := c.artifactLabels(claim, ds); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, labels)
+	}
+}
+
+func TestSyncPvcArtifactMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		mutatorErr  error
+		rename      bool
+		expectPrime bool
+	}{
+		{
+			name:        "Mutator succeeds",
+			expectPrime: true,
+		},
+		{
+			name:       "Mutator fails",
+			mutatorErr: fmt.Errorf("mutator failed"),
+		},
+		{
+			name:   "Mutator moves PVC'",
+			rename: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			claim.UID = types.UID(testPvcUid)
+			claim.Labels = map[string]string{"app": "db", "team": "storage"}
+			claim.Annotations["example.com/owner"] = "alice"
+			claim.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "fast"}}
+			c, _ := initSyncTest(t, claim, ust(), sc())
+			c.pvcPrime = PvcPrimeConfig{
+				Labels:      []string{"app"},
+				Annotations: []string{PropagateAll},
+				Mutator: func(pvcPrime, pvc *corev1.PersistentVolumeClaim) error {
+					pvcPrime.Spec.Selector = pvc.Spec.Selector
+					if test.rename {
+						pvcPrime.Namespace = testPvcNamespace
+					}
+					return test.mutatorErr
+				},
+			}
+
+			err := syncTestPvc(c)
+			if (err != nil) != (test.mutatorErr != nil || test.rename) {
+				t.Fatalf("Expected error %t, got %v", test.mutatorErr != nil || test.rename, err)
+			}
+
+			ds := c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}]
+			expectedLabels := c.artifactLabels(claim, ds)
+			pod, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pod failed: %v", err)
+			}
+			if !reflect.DeepEqual(pod.Labels, expectedLabels) {
+				t.Errorf("Expected pod labels %v, got %v", expectedLabels, pod.Labels)
+			}
+
+			pvcPrime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if !test.expectPrime {
+				if err == nil {
+					t.Errorf("Expected no PVC'")
+				}
+				if _, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{}); err == nil {
+					t.Errorf("Expected no PVC' in namespace %s", testPvcNamespace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get PVC' failed: %v", err)
+			}
+			expectedLabels["app"] = "db"
+			if !reflect.DeepEqual(pvcPrime.Labels, expectedLabels) {
+				t.Errorf("Expected PVC' labels %v, got %v", expectedLabels, pvcPrime.Labels)
+			}
+			expectedAnnotations := map[string]string{
+				"example.com/owner": "alice",
+				annSelectedNode:     testNodeName,
+			}
+			if !reflect.DeepEqual(pvcPrime.Annotations, expectedAnnotations) {
+				t.Errorf("Expected PVC' annotations %v, got %v", expectedAnnotations, pvcPrime.Annotations)
+			}
+			if !reflect.DeepEqual(pvcPrime.Spec.Selector, claim.Spec.Selector) {
+				t.Errorf("Expected PVC' selector %v, got %v", claim.Spec.Selector, pvcPrime.Spec.Selector)
+			}
+		})
+	}
+}
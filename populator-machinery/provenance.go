@@ -0,0 +1,78 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Annotations on populated PVs that record which data source, and which
+// version of it, the volume was populated from. The version is recorded on
+// the populator pod, or on PVC' for providers, when population starts, so
+// that later changes to the data source don't show up on the PV.
+const (
+	populatedFromKindAnnoSuffix    = "populated-from-kind"
+	populatedFromUIDAnnoSuffix     = "populated-from-uid"
+	populatedFromVersionAnnoSuffix = "populated-from-resource-version"
+	populatedFromGenAnnoSuffix     = "populated-from-generation"
+	populatorImageAnnoSuffix       = "populator-image"
+	populatedAtAnnoSuffix          = "populated-at"
+)
+
+// sourceProvenance returns the annotations that identify the current version
+// of a data source.
+func (c *controller) sourceProvenance(ds *dataSource, source *unstructured.Unstructured) map[string]string {
+	return map[string]string{
+		c.populatedFromAnno: source.GetNamespace() + "/" + source.GetName(),
+		c.sourceKindAnno:    ds.gk.String(),
+		c.sourceUIDAnno:     string(source.GetUID()),
+		c.sourceVersionAnno: source.GetResourceVersion(),
+		c.sourceGenAnno:     strconv.FormatInt(source.GetGeneration(), 10),
+	}
+}
+
+// pvProvenance returns the annotations for a populated PV. The data source
+// version is taken from the populator pod, or from PVC' without a pod. It
+// falls back to the current version of the data source for populations
+// started before it was recorded.
+func (c *controller) pvProvenance(ds *dataSource, source *unstructured.Unstructured, pod *corev1.Pod,
+	pvcPrime *corev1.PersistentVolumeClaim,
+) map[string]string {
+	annotations := c.sourceProvenance(ds, source)
+	recorded := pvcPrime.Annotations
+	if pod != nil {
+		recorded = pod.Annotations
+	}
+	for anno := range annotations {
+		if value, ok := recorded[anno]; ok {
+			annotations[anno] = value
+		}
+	}
+	if pod != nil {
+		for _, con := range pod.Spec.Containers {
+			if con.Name == populatorContainerName {
+				annotations[c.imageAnno] = con.Image
+			}
+		}
+	}
+	annotations[c.populatedAtAnno] = time.Now().UTC().Format(time.RFC3339)
+	return annotations
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSyncPvcProvenance(t *testing.T) {
+	kind := testDatasourceKind + "." + testApiGroup
+
+	tests := []struct {
+		name            string
+		podAnnotations  map[string]string
+		expectedVersion string
+		expectedGen     string
+	}{
+		{
+			name: "Version recorded when population started",
+			podAnnotations: map[string]string{
+				testPrefix + "/" + populatedFromVersionAnnoSuffix: "1",
+				testPrefix + "/" + populatedFromGenAnnoSuffix:     "1",
+			},
+			expectedVersion: "1",
+			expectedGen:     "1",
+		},
+		{
+			name:            "Nothing recorded",
+			expectedVersion: "2",
+			expectedGen:     "2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+			pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, "")
+			p := pod(corev1.PodSucceeded)
+			p.Annotations = test.podAnnotations
+			p.Spec.Containers = []corev1.Container{{Name: populatorContainerName, Image: "test-image:v1"}}
+			source := ust()
+			source.SetNamespace(testDataSourceNamespace)
+			source.SetUID(types.UID("source-uid"))
+			source.SetResourceVersion("2")
+			source.SetGeneration(2)
+			volume := pv(testPopulatorPvcName, testVpWorkingNamespace, "")
+			c, _ := initSyncTest(t, claim, pvcPrime, p, source, sc(), volume)
+			c.authorizer = NewStaticAuthorizer(true, "")
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, err := c.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), testPvName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pv failed: %v", err)
+			}
+			expected := map[string]string{
+				populatedFromAnnoSuffix:        testDataSourceNamespace + "/" + testDataSourceName,
+				populatedFromKindAnnoSuffix:    kind,
+				populatedFromUIDAnnoSuffix:     "source-uid",
+				populatedFromVersionAnnoSuffix: test.expectedVersion,
+				populatedFromGenAnnoSuffix:     test.expectedGen,
+				populatorImageAnnoSuffix:       "test-image:v1",
+			}
+			for suffix, value := range expected {
+				if got.Annotations[testPrefix+"/"+suffix] != value {
+					t.Errorf("Expected annotation %s to be %q, got %q", suffix, value, got.Annotations[testPrefix+"/"+suffix])
+				}
+			}
+			if _, err := time.Parse(time.RFC3339, got.Annotations[testPrefix+"/"+populatedAtAnnoSuffix]); err != nil {
+				t.Errorf("Expected completion time annotation: %v", err)
+			}
+		})
+	}
+}
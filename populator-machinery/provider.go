@@ -0,0 +1,162 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// defaultProviderPollInterval is how often PopulateCompleteFn is called
+	// while a population is in progress.
+	defaultProviderPollInterval = 10 * time.Second
+
+	reasonProviderFailed = "PopulatorProviderFailed"
+
+	// populateCompleteAnnoSuffix marks PVC' once PopulateCompleteFn reported
+	// completion.
+	populateCompleteAnnoSuffix = "populate-complete"
+)
+
+// PopulatorParams are passed to the provider functions.
+type PopulatorParams struct {
+	// KubeClient is the controller's client.
+	KubeClient kubernetes.Interface
+	// Pvc is the PVC being populated.
+	Pvc *corev1.PersistentVolumeClaim
+	// PvcPrime is the bound PVC' in the populator namespace. Its volume is
+	// the one that has to be populated.
+	PvcPrime *corev1.PersistentVolumeClaim
+	// Unstructured is the data source of Pvc.
+	Unstructured *unstructured.Unstructured
+	// Recorder records events, for example on Pvc.
+	Recorder record.EventRecorder
+}
+
+// ProviderFunctionConfig lets a populator fill volumes in process, for example
+// by calling a storage backend API, instead of running a populator pod. The
+// controller still creates PVC', waits for it to be bound and moves its volume
+// to the PVC once the population is complete.
+type ProviderFunctionConfig struct {
+	// PopulateFn starts populating the volume of PvcPrime. It is called on
+	// every sync of an unfinished population, so it must be idempotent and
+	// should return quickly. Once PopulateCompleteFn reported completion,
+	// neither of them is called again for the same PVC'.
+	PopulateFn func(ctx context.Context, params PopulatorParams) error
+	// PopulateCompleteFn returns true once the population is complete.
+	PopulateCompleteFn func(ctx context.Context, params PopulatorParams) (bool, error)
+	// PostPopulateFn, if set, is called after the population is complete and
+	// before the volume is moved to the PVC. It may be called more than
+	// once.
+	PostPopulateFn func(ctx context.Context, params PopulatorParams) error
+	// PollInterval is how often the controller checks an unfinished
+	// population. Defaults to 10s.
+	PollInterval time.Duration
+}
+
+// populateWithProvider drives the provider functions for the given PVC and
+// returns true once the volume of PVC' is populated. Errors of the provider
+// functions are failed attempts, which the caller handles like failed
+// populator pods.
+func (c *controller) populateWithProvider(ctx context.Context, key string, provider *ProviderFunctionConfig,
+	params PopulatorParams,
+) (bool, error) {
+	if params.PvcPrime.Spec.VolumeName == "" {
+		// We'll get called again later when PVC' is bound
+		return false, nil
+	}
+	if c.providerComplete(params.Pvc, params.PvcPrime) {
+		// Calling the provider again could start the population over, or
+		// fail the attempt and delete the populated volume
+		return true, nil
+	}
+
+	err := provider.PopulateFn(ctx, params)
+	if err != nil {
+		return false, fmt.Errorf("failed to populate volume: %w", err)
+	}
+	complete, err := provider.PopulateCompleteFn(ctx, params)
+	if err != nil {
+		return false, fmt.Errorf("failed to check volume population: %w", err)
+	}
+	if !complete {
+		// Nothing notifies us about the progress of the provider, so poll
+		c.workqueue.AddAfter(key, provider.PollInterval)
+		return false, nil
+	}
+	return true, nil
+}
+
+// providerComplete returns true once the provider populated the volume of
+// PVC'.
+func (c *controller) providerComplete(pvc, pvcPrime *corev1.PersistentVolumeClaim) bool {
+	return metav1.HasAnnotation(pvcPrime.ObjectMeta, c.completeAnno) || c.handOverStarted(pvc, pvcPrime)
+}
+
+// recordComplete marks PVC' as populated, so that the provider isn't called
+// for it anymore.
+func (c *controller) recordComplete(ctx context.Context, pvcPrime *corev1.PersistentVolumeClaim) error {
+	if metav1.HasAnnotation(pvcPrime.ObjectMeta, c.completeAnno) {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				c.completeAnno: "true",
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvcPrime.Namespace).Patch(ctx, pvcPrime.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
+
+// postPopulate calls the provider's PostPopulateFn, if any.
+func (c *controller) postPopulate(ctx context.Context, provider *ProviderFunctionConfig, params PopulatorParams) error {
+	if provider == nil || provider.PostPopulateFn == nil {
+		return nil
+	}
+	err := provider.PostPopulateFn(ctx, params)
+	if err != nil {
+		c.recorder.Eventf(params.Pvc, corev1.EventTypeWarning, reasonProviderFailed, "Failed to finish volume population: %s", err)
+	}
+	return err
+}
+
+func (c *controller) populatorParams(pvc, pvcPrime *corev1.PersistentVolumeClaim, dataSource *unstructured.Unstructured) PopulatorParams {
+	return PopulatorParams{
+		KubeClient:   c.kubeClient,
+		Pvc:          pvc,
+		PvcPrime:     pvcPrime,
+		Unstructured: dataSource,
+		Recorder:     c.recorder,
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeProvider struct {
+	populateCalls     int
+	postPopulateCalls int
+	complete          bool
+	populateErr       error
+	completeErr       error
+}
+
+func (p *fakeProvider) config() *ProviderFunctionConfig {
+	return &ProviderFunctionConfig{
+		PopulateFn: func(ctx context.Context, params PopulatorParams) error {
+			if params.Pvc == nil || params.PvcPrime == nil || params.Unstructured == nil {
+				return fmt.Errorf("missing params")
+			}
+			p.populateCalls++
+			return p.populateErr
+		},
+		PopulateCompleteFn: func(ctx context.Context, params PopulatorParams) (bool, error) {
+			return p.complete, p.completeErr
+		},
+		PostPopulateFn: func(ctx context.Context, params PopulatorParams) error {
+			p.postPopulateCalls++
+			return nil
+		},
+		PollInterval: defaultProviderPollInterval,
+	}
+}
+
+func TestSyncPvcProvider(t *testing.T) {
+	completeAnno := testPrefix + "/" + populateCompleteAnnoSuffix
+	completePvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimBound)
+	completePvcPrime.Annotations[completeAnno] = "true"
+
+	tests := []struct {
+		name         string
+		pvcPrime     *corev1.PersistentVolumeClaim
+		provider     fakeProvider
+		expectCalls  int
+		expectPost   int
+		expectRebind bool
+	}{
+		{
+			name: "Create PVC'",
+		},
+		{
+			name:     "Wait for PVC' to be bound",
+			pvcPrime: pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, corev1.ClaimPending),
+		},
+		{
+			name:        "Population in progress",
+			pvcPrime:    pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimBound),
+			expectCalls: 1,
+		},
+		{
+			name:         "Population complete",
+			pvcPrime:     pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimBound),
+			provider:     fakeProvider{complete: true},
+			expectCalls:  1,
+			expectPost:   1,
+			expectRebind: true,
+		},
+		{
+			name:     "Provider isn't called after completion",
+			pvcPrime: completePvcPrime,
+			// A late call must not fail the attempt and delete PVC'
+			provider:     fakeProvider{populateErr: fmt.Errorf("backend unavailable")},
+			expectPost:   1,
+			expectRebind: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			objects := []runtime.Object{claim, pv(testPopulatorPvcName, testVpWorkingNamespace, ""), ust(), sc()}
+			if test.pvcPrime != nil {
+				objects = append(objects, test.pvcPrime)
+			}
+			c, _ := initSyncTest(t, objects...)
+			provider := test.provider
+			c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}].provider = provider.config()
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if provider.populateCalls != test.expectCalls {
+				t.Errorf("Expected %d populate calls, got %d", test.expectCalls, provider.populateCalls)
+			}
+			if provider.postPopulateCalls != test.expectPost {
+				t.Errorf("Expected %d post populate calls, got %d", test.expectPost, provider.postPopulateCalls)
+			}
+			pods, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("List pods failed: %v", err)
+			}
+			if len(pods.Items) != 0 {
+				t.Errorf("Expected no populator pods, got %d", len(pods.Items))
+			}
+			gotPrime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Errorf("Expected PVC' to exist: %v", err)
+			} else if _, complete := gotPrime.Annotations[completeAnno]; complete != test.expectRebind {
+				t.Errorf("Expected completion recorded %t, got %t", test.expectRebind, complete)
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), testPvName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pv failed: %v", err)
+			}
+			rebound := got.Spec.ClaimRef.Name == testPvcName && got.Spec.ClaimRef.Namespace == testPvcNamespace
+			if rebound != test.expectRebind {
+				t.Errorf("Expected rebind %t, got claim ref %s/%s", test.expectRebind, got.Spec.ClaimRef.Namespace, got.Spec.ClaimRef.Name)
+			}
+		})
+	}
+}
+
+func TestSyncPvcProviderFailure(t *testing.T) {
+	attemptsAnno := testPrefix + "/" + populateAttemptsAnnoSuffix
+	lastFailureAnno := testPrefix + "/" + populateLastFailureAnnoSuffix
+	failedAnno := testPrefix + "/" + populateFailedAnnoSuffix
+	failureAnno := testPrefix + "/" + populateFailureAnnoSuffix
+
+	tests := []struct {
+		name        string
+		provider    fakeProvider
+		annotations map[string]string
+		noPvcPrime  bool
+		handedOver  bool
+		// Expected state after the sync
+		expectReason   string
+		expectAttempts string
+		expectFailure  string
+		expectFailed   bool
+		expectPvcPrime bool
+	}{
+		{
+			name:           "Populate failure is retried",
+			provider:       fakeProvider{populateErr: fmt.Errorf("backend unavailable")},
+			expectReason:   reasonPodFailed,
+			expectAttempts: "1",
+			expectFailure:  "failed to populate volume: backend unavailable",
+		},
+		{
+			name:           "Completion check failure is retried",
+			provider:       fakeProvider{completeErr: fmt.Errorf("backend unavailable")},
+			expectReason:   reasonPodFailed,
+			expectAttempts: "1",
+			expectFailure:  "failed to check volume population: backend unavailable",
+		},
+		{
+			name:           "Retries exhausted",
+			provider:       fakeProvider{populateErr: fmt.Errorf("backend unavailable")},
+			annotations:    map[string]string{attemptsAnno: "2"},
+			expectReason:   reasonRetriesExhausted,
+			expectAttempts: "3",
+			expectFailure:  "failed to populate volume: backend unavailable",
+			expectFailed:   true,
+		},
+		{
+			name: "Wait for backoff before creating PVC'",
+			annotations: map[string]string{
+				attemptsAnno:    "1",
+				lastFailureAnno: time.Now().UTC().Format(time.RFC3339),
+			},
+			noPvcPrime:     true,
+			expectAttempts: "1",
+		},
+		{
+			name:           "Provider isn't called after the hand over started",
+			provider:       fakeProvider{populateErr: fmt.Errorf("backend unavailable")},
+			handedOver:     true,
+			expectPvcPrime: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := populatingPvc()
+			for k, v := range test.annotations {
+				claim.Annotations[k] = v
+			}
+			volume := pv(testPopulatorPvcName, testVpWorkingNamespace, "")
+			if test.handedOver {
+				volume = pv(testPvcName, testPvcNamespace, testPvcUid)
+			}
+			objects := []runtime.Object{claim, volume, ust(), sc()}
+			if !test.noPvcPrime {
+				objects = append(objects, pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimBound))
+			}
+			c, recorder := initSyncTest(t, objects...)
+			c.retryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}
+			c.retryPolicy.setDefaults()
+			provider := test.provider
+			c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}].provider = provider.config()
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if test.expectReason != "" {
+				if n := countEvents(recorder, test.expectReason); n != 1 {
+					t.Errorf("Expected one %s event, got %d", test.expectReason, n)
+				}
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if attempts := got.Annotations[attemptsAnno]; attempts != test.expectAttempts {
+				t.Errorf("Expected %q attempts, got %q", test.expectAttempts, attempts)
+			}
+			if failure := got.Annotations[failureAnno]; failure != test.expectFailure {
+				t.Errorf("Expected failure %q, got %q", test.expectFailure, failure)
+			}
+			if _, failed := got.Annotations[failedAnno]; failed != test.expectFailed {
+				t.Errorf("Expected failed %t, got %t", test.expectFailed, failed)
+			}
+			_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if (err == nil) != test.expectPvcPrime {
+				t.Errorf("Expected PVC' %t, got error %v", test.expectPvcPrime, err)
+			}
+		})
+	}
+}
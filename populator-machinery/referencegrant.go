@@ -0,0 +1,278 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+const (
+	// dataSourceNamespaceIndex indexes PVCs by the namespace of a data
+	// source in another namespace, so that they can be found when a
+	// ReferenceGrant in that namespace changes.
+	dataSourceNamespaceIndex = "dataSourceNamespace"
+
+	referenceGrantResource = "referencegrants"
+	// referenceGrantPollInterval is how often discovery is checked for the
+	// ReferenceGrant API while it is not installed.
+	referenceGrantPollInterval = time.Minute
+
+	reasonWaitingForReferenceGrant  = "PopulatorWaitingForReferenceGrant"
+	reasonCrossNamespaceUnsupported = "PopulatorCrossNamespaceUnsupported"
+)
+
+// referenceGrantVersions are the ReferenceGrant API versions the controller
+// understands, newest first. They share the same schema, so all of them are
+// read into v1beta1 objects.
+var referenceGrantVersions = []string{"v1", "v1beta1", "v1alpha2"}
+
+// referenceGrantGVR negotiates the ReferenceGrant API version through
+// discovery. The version preferred by the server is used if the controller
+// understands it, otherwise the newest served version the controller
+// understands. It returns false if no such version is served.
+func referenceGrantGVR(discoveryClient discovery.DiscoveryInterface) (schema.GroupVersionResource, bool, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	for _, group := range groups.Groups {
+		if group.Name != gatewayv1beta1.GroupName {
+			continue
+		}
+		served := make(map[string]bool)
+		for _, version := range group.Versions {
+			served[version.Version] = true
+		}
+		candidates := append([]string{group.PreferredVersion.Version}, referenceGrantVersions...)
+		for _, version := range candidates {
+			if !served[version] || !knownReferenceGrantVersion(version) {
+				continue
+			}
+			gvr := schema.GroupVersionResource{Group: group.Name, Version: version, Resource: referenceGrantResource}
+			found, err := servesResource(discoveryClient, gvr)
+			if err != nil {
+				return schema.GroupVersionResource{}, false, err
+			}
+			if found {
+				return gvr, true, nil
+			}
+		}
+	}
+	return schema.GroupVersionResource{}, false, nil
+}
+
+func knownReferenceGrantVersion(version string) bool {
+	for _, v := range referenceGrantVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// servesResource checks through discovery whether gvr is served.
+func servesResource(discoveryClient discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (bool, error) {
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// startReferenceGrants watches ReferenceGrants if their API is installed.
+// Otherwise data sources in other namespaces are not supported, and discovery
+// is checked in the background until the API shows up. Background work is
+// tracked in wg.
+func (c *controller) startReferenceGrants(ctx context.Context, discoveryClient discovery.DiscoveryInterface,
+	factory dynamicinformer.DynamicSharedInformerFactory, wg *sync.WaitGroup,
+) {
+	gvr, found, err := referenceGrantGVR(discoveryClient)
+	if err != nil {
+		klog.Warningf("Failed to look for the ReferenceGrant API: %v", err)
+	}
+	if found {
+		// The controller waits for the informer to sync before it starts
+		c.watchReferenceGrants(factory, gvr)
+		atomic.StoreInt32(&c.referenceGrantsFound, 1)
+		return
+	}
+
+	klog.Infof("ReferenceGrant API not found, data sources in other namespaces are not supported until it is installed")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := wait.PollUntilContextCancel(ctx, referenceGrantPollInterval, false, func(ctx context.Context) (bool, error) {
+			var err error
+			gvr, found, err = referenceGrantGVR(discoveryClient)
+			if err != nil {
+				klog.V(2).Infof("Failed to look for the ReferenceGrant API: %v", err)
+			}
+			return found, nil
+		})
+		if err != nil {
+			// Cancelled
+			return
+		}
+		c.watchReferenceGrants(factory, gvr)
+		factory.Start(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), c.referenceGrantSynced) {
+			return
+		}
+		atomic.StoreInt32(&c.referenceGrantsFound, 1)
+		klog.Infof("ReferenceGrant API %s found, data sources in other namespaces are supported now", gvr.GroupVersion())
+		c.requeueCrossNamespacePVCs()
+	}()
+}
+
+// watchReferenceGrants adds the informer for ReferenceGrants of the given
+// version to factory. It still has to be started.
+func (c *controller) watchReferenceGrants(factory dynamicinformer.DynamicSharedInformerFactory, gvr schema.GroupVersionResource) {
+	klog.Infof("Using ReferenceGrant API %s", gvr.GroupVersion())
+	informer := factory.ForResource(gvr).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.handleReferenceGrant,
+		UpdateFunc: func(old, new interface{}) {
+			newGrant := new.(*unstructured.Unstructured)
+			oldGrant := old.(*unstructured.Unstructured)
+			if newGrant.GetResourceVersion() == oldGrant.GetResourceVersion() {
+				return
+			}
+			c.handleReferenceGrant(new)
+		},
+		DeleteFunc: c.handleReferenceGrant,
+	})
+	c.referenceGrantLister = dynamiclister.New(informer.GetIndexer(), gvr)
+	c.referenceGrantSynced = informer.HasSynced
+}
+
+// listReferenceGrants returns the ReferenceGrants in a namespace, whatever
+// version of the API is served.
+func (c *controller) listReferenceGrants(namespace string) ([]*gatewayv1beta1.ReferenceGrant, error) {
+	objs, err := c.referenceGrantLister.Namespace(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]*gatewayv1beta1.ReferenceGrant, 0, len(objs))
+	for _, obj := range objs {
+		grant, err := referenceGrantFromUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// referenceGrantFromUnstructured converts a ReferenceGrant of any known
+// version to v1beta1.
+func referenceGrantFromUnstructured(obj *unstructured.Unstructured) (*gatewayv1beta1.ReferenceGrant, error) {
+	gv, err := schema.ParseGroupVersion(obj.GetAPIVersion())
+	if err != nil {
+		return nil, err
+	}
+	if gv.Group != gatewayv1beta1.GroupName || !knownReferenceGrantVersion(gv.Version) {
+		return nil, fmt.Errorf("unsupported ReferenceGrant version %s", obj.GetAPIVersion())
+	}
+	grant := &gatewayv1beta1.ReferenceGrant{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), grant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert ReferenceGrant %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return grant, nil
+}
+
+// referenceGrantsEnabled returns true if ReferenceGrants can be used to allow
+// data sources in other namespaces.
+func (c *controller) referenceGrantsEnabled() bool {
+	return atomic.LoadInt32(&c.referenceGrantsFound) == 1
+}
+
+// requeueCrossNamespacePVCs requeues all PVCs with a data source in another
+// namespace.
+func (c *controller) requeueCrossNamespacePVCs() {
+	for _, namespace := range c.pvcIndexer.ListIndexFuncValues(dataSourceNamespaceIndex) {
+		pvcs, err := c.pvcIndexer.ByIndex(dataSourceNamespaceIndex, namespace)
+		if err != nil {
+			klog.Errorf("Failed to find PVCs with data sources in namespace %s: %v", namespace, err)
+			continue
+		}
+		c.requeuePVCs(pvcs)
+	}
+}
+
+func (c *controller) requeuePVCs(pvcs []interface{}) {
+	for _, obj := range pvcs {
+		if pvc, ok := obj.(*corev1.PersistentVolumeClaim); ok {
+			c.workqueue.Add("pvc/" + pvc.Namespace + "/" + pvc.Name)
+		}
+	}
+}
+
+// dataSourceNamespaceIndexFunc returns the namespace of the data source of a
+// PVC, if it is in another namespace than the PVC.
+func dataSourceNamespaceIndexFunc(obj interface{}) ([]string, error) {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return nil, nil
+	}
+	ref := pvc.Spec.DataSourceRef
+	if ref == nil || ref.Namespace == nil || *ref.Namespace == "" || *ref.Namespace == pvc.Namespace {
+		return nil, nil
+	}
+	return []string{*ref.Namespace}, nil
+}
+
+// handleReferenceGrant requeues all PVCs with a data source in the namespace
+// of the ReferenceGrant, because they may be allowed or denied now.
+func (c *controller) handleReferenceGrant(obj interface{}) {
+	object := translateObject(obj)
+	if object == nil {
+		return
+	}
+	pvcs, err := c.pvcIndexer.ByIndex(dataSourceNamespaceIndex, object.GetNamespace())
+	if err != nil {
+		klog.Errorf("Failed to find PVCs for ReferenceGrant %s/%s: %v", object.GetNamespace(), object.GetName(), err)
+		return
+	}
+	c.requeuePVCs(pvcs)
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+const testDataSourceNamespace = "default1"
+
+func TestHandleReferenceGrant(t *testing.T) {
+	c, pvcInformer, _, _, _, _ := initTest()
+
+	crossNamespace := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+	sameNamespace := pvc(testPvcName+"-local", testPvcNamespace, "", testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	otherNamespace := pvc(testPvcName+"-other", testPvcNamespace, "", testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, "default2"), "")
+	for _, claim := range []*corev1.PersistentVolumeClaim{crossNamespace, sameNamespace, otherNamespace} {
+		pvcInformer.Informer().GetStore().Add(claim)
+	}
+
+	c.handleReferenceGrant(generateReferenceGrant(testDataSourceNamespace, nil, nil))
+
+	if n := c.workqueue.Len(); n != 1 {
+		t.Fatalf("Expected 1 PVC to be queued, got %d", n)
+	}
+	key, _ := c.workqueue.Get()
+	if expected := "pvc/" + testPvcNamespace + "/" + testPvcName; key != expected {
+		t.Errorf("Expected %s to be queued, got %s", expected, key)
+	}
+}
+
+func TestSyncPvcWaitForReferenceGrant(t *testing.T) {
+	finalizer := testPrefix + "/" + pvcFinalizerSuffix
+
+	tests := []struct {
+		name       string
+		started    bool
+		boundPvc   bool
+		expectKept bool
+	}{
+		{
+			name: "Not started",
+		},
+		{
+			name:    "Grant revoked during population",
+			started: true,
+		},
+		{
+			name:       "Grant revoked after population",
+			started:    true,
+			boundPvc:   true,
+			expectKept: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumeName := ""
+			if test.boundPvc {
+				volumeName = testPvName
+			}
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, volumeName,
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+			objects := []runtime.Object{claim}
+			if test.started {
+				claim.Finalizers = append(claim.Finalizers, finalizer)
+				pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+				objects = append(objects, pod(corev1.PodRunning), pvcPrime)
+			}
+			c, recorder := initSyncTest(t, objects...)
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if n := countEvents(recorder, reasonWaitingForReferenceGrant); n != 1 {
+				t.Errorf("Expected one %s event, got %d", reasonWaitingForReferenceGrant, n)
+			}
+			_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if (err == nil) != test.expectKept {
+				t.Errorf("Expected pod %t, got error %v", test.expectKept, err)
+			}
+			_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if (err == nil) != test.expectKept {
+				t.Errorf("Expected PVC' %t, got error %v", test.expectKept, err)
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if hasFinalizer(got, finalizer) != test.boundPvc {
+				t.Errorf("Expected finalizer %t, got finalizers %v", test.boundPvc, got.Finalizers)
+			}
+		})
+	}
+}
+
+func TestStartReferenceGrants(t *testing.T) {
+	tests := []struct {
+		name          string
+		resources     []*metav1.APIResourceList
+		expectEnabled bool
+	}{
+		{
+			name: "API not installed",
+		},
+		{
+			name: "Other gateway resources only",
+			resources: []*metav1.APIResourceList{
+				{
+					GroupVersion: gatewayv1beta1.GroupVersion.String(),
+					APIResources: []metav1.APIResource{{Name: "gateways"}},
+				},
+			},
+		},
+		{
+			name: "API installed",
+			resources: []*metav1.APIResourceList{
+				{
+					GroupVersion: gatewayv1beta1.GroupVersion.String(),
+					APIResources: []metav1.APIResource{{Name: "gateways"}, {Name: referenceGrantResource}},
+				},
+			},
+			expectEnabled: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, _, _, _, _ := initTest()
+			c.referenceGrantsFound = 0
+			c.referenceGrantLister = nil
+			c.referenceGrantSynced = nil
+			discoveryClient := kubefake.NewSimpleClientset().Discovery().(*fake.FakeDiscovery)
+			discoveryClient.Resources = test.resources
+			factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			c.startReferenceGrants(ctx, discoveryClient, factory, &wg)
+			if enabled := c.referenceGrantsEnabled(); enabled != test.expectEnabled {
+				t.Errorf("Expected ReferenceGrants enabled %t, got %t", test.expectEnabled, enabled)
+			}
+			if test.expectEnabled && c.referenceGrantLister == nil {
+				t.Errorf("Expected ReferenceGrant lister to be set")
+			}
+			// The background check must stop once the context is cancelled
+			cancel()
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Errorf("Background check did not stop")
+			}
+		})
+	}
+}
+
+func TestReferenceGrantGVR(t *testing.T) {
+	grantResources := func(version string) *metav1.APIResourceList {
+		return &metav1.APIResourceList{
+			GroupVersion: gatewayv1beta1.GroupName + "/" + version,
+			APIResources: []metav1.APIResource{{Name: referenceGrantResource}},
+		}
+	}
+	tests := []struct {
+		name          string
+		resources     []*metav1.APIResourceList
+		expectFound   bool
+		expectVersion string
+	}{
+		{
+			name: "API not installed",
+		},
+		{
+			name:          "v1beta1 only",
+			resources:     []*metav1.APIResourceList{grantResources("v1beta1")},
+			expectFound:   true,
+			expectVersion: "v1beta1",
+		},
+		{
+			name:          "v1alpha2 only",
+			resources:     []*metav1.APIResourceList{grantResources("v1alpha2")},
+			expectFound:   true,
+			expectVersion: "v1alpha2",
+		},
+		{
+			name:          "v1 only",
+			resources:     []*metav1.APIResourceList{grantResources("v1")},
+			expectFound:   true,
+			expectVersion: "v1",
+		},
+		{
+			name:          "Preferred version is used",
+			resources:     []*metav1.APIResourceList{grantResources("v1beta1"), grantResources("v1")},
+			expectFound:   true,
+			expectVersion: "v1beta1",
+		},
+		{
+			name:          "Unknown preferred version falls back to the newest known version",
+			resources:     []*metav1.APIResourceList{grantResources("v2"), grantResources("v1alpha2"), grantResources("v1beta1")},
+			expectFound:   true,
+			expectVersion: "v1beta1",
+		},
+		{
+			name:      "Unknown version only",
+			resources: []*metav1.APIResourceList{grantResources("v2")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			discoveryClient := kubefake.NewSimpleClientset().Discovery().(*fake.FakeDiscovery)
+			discoveryClient.Resources = test.resources
+			gvr, found, err := referenceGrantGVR(discoveryClient)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if found != test.expectFound {
+				t.Fatalf("Expected found %t, got %t", test.expectFound, found)
+			}
+			if found && gvr.Version != test.expectVersion {
+				t.Errorf("Expected version %s, got %s", test.expectVersion, gvr.Version)
+			}
+		})
+	}
+}
+
+func TestReferenceGrantFromUnstructured(t *testing.T) {
+	for _, apiVersion := range []string{"v1", gatewayv1beta1.GroupName + "/v2", "example.com/v1beta1"} {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind("ReferenceGrant")
+		if _, err := referenceGrantFromUnstructured(obj); err == nil {
+			t.Errorf("Expected error for ReferenceGrant %s", apiVersion)
+		}
+	}
+}
+
+func TestSyncPvcReferenceGrantsUnsupported(t *testing.T) {
+	c, pvcInformer, _, _, _, _ := initTest()
+	c.referenceGrantsFound = 0
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testDataSourceNamespace), "")
+	pvcInformer.Informer().GetStore().Add(claim)
+
+	if err := c.syncPvc(context.TODO(), "pvc/"+testPvcNamespace+"/"+testPvcName, testPvcNamespace, testPvcName); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countEvents(recorder, reasonCrossNamespaceUnsupported); n != 1 {
+		t.Errorf("Expected one %s event, got %d", reasonCrossNamespaceUnsupported, n)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RenderedObjects are the objects the controller would create to populate a
+// PVC.
+type RenderedObjects struct {
+	// Pod is the populator pod. It is nil for data sources with provider
+	// functions, which populate PVC' without a pod.
+	Pod *corev1.Pod
+	// PvcPrime is the PVC the volume is provisioned and populated for.
+	PvcPrime *corev1.PersistentVolumeClaim
+}
+
+// Render returns the populator pod and PVC' the controller would create for
+// pvc, without connecting to a cluster. It uses the same code as the
+// controller, including the PopulatorArgs, PodMutator and PvcPrime settings of
+// cfg, so that populators can check their manifests in golden tests.
+// storageClass may be nil for PVCs without a StorageClass. The PVC must have a
+// UID, because the names of the objects are derived from it.
+func Render(cfg VolumePopulatorConfig, pvc *corev1.PersistentVolumeClaim, storageClass *storagev1.StorageClass,
+	source *unstructured.Unstructured,
+) (*RenderedObjects, error) {
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid populator config: %v", err)
+	}
+	if pvc.UID == "" {
+		return nil, fmt.Errorf("PVC %s/%s has no UID", pvc.Namespace, pvc.Name)
+	}
+
+	dataSourceRef := pvc.Spec.DataSourceRef
+	if dataSourceRef == nil || dataSourceRef.Name == "" {
+		return nil, fmt.Errorf("PVC %s/%s has no data source", pvc.Namespace, pvc.Name)
+	}
+	dataSources := make(map[schema.GroupKind]*dataSource)
+	for _, dsc := range cfg.dataSourceConfigs() {
+		dataSources[dsc.Gk] = newDataSource(dsc)
+	}
+	c := newController(&cfg, dataSources)
+
+	ds, dataSourceRefNamespace := c.dataSourceOf(pvc)
+	if ds == nil {
+		return nil, fmt.Errorf("data source kind %s is not handled by this populator", dataSourceGroupKind(dataSourceRef))
+	}
+	if source.GroupVersionKind().GroupKind() != ds.gk || source.GetNamespace() != dataSourceRefNamespace ||
+		source.GetName() != dataSourceRef.Name {
+		return nil, fmt.Errorf("data source %s %s/%s is not the data source of PVC %s/%s",
+			source.GroupVersionKind().GroupKind(), source.GetNamespace(), source.GetName(), pvc.Namespace, pvc.Name)
+	}
+
+	var waitForFirstConsumer bool
+	var nodeName string
+	if pvc.Spec.StorageClassName != nil {
+		if storageClass == nil || storageClass.Name != *pvc.Spec.StorageClassName {
+			return nil, fmt.Errorf("StorageClass %s of PVC %s/%s is missing", *pvc.Spec.StorageClassName, pvc.Namespace, pvc.Name)
+		}
+		var err error
+		waitForFirstConsumer, nodeName, err = c.resolveStorageClass(pvc, storageClass)
+		if err != nil {
+			return nil, err
+		}
+		if waitForFirstConsumer && nodeName == "" {
+			return nil, fmt.Errorf("PVC %s/%s has no selected node, which StorageClass %s requires", pvc.Namespace, pvc.Name, storageClass.Name)
+		}
+	}
+
+	podName, pvcPrimeName := populatorNames(pvc.UID)
+	objects := &RenderedObjects{}
+	var annotations map[string]string
+	if ds.provider != nil {
+		// Without a pod, PVC' records which version of the data source is
+		// populated
+		annotations = c.sourceProvenance(ds, source)
+	} else {
+		pod, err := c.makePopulatorPod(pvc, ds, source, podName, pvcPrimeName, nodeName, waitForFirstConsumer)
+		if err != nil {
+			return nil, err
+		}
+		err = c.mutatePod(pod, pvc, source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to customize populator pod: %v", err)
+		}
+		pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+		objects.Pod = pod
+	}
+	pvcPrime, err := c.makePvcPrime(pvc, ds, pvcPrimeName, nodeName, annotations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create populator PVC: %v", err)
+	}
+	pvcPrime.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+	objects.PvcPrime = pvcPrime
+	return objects, nil
+}
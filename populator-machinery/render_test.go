@@ -0,0 +1,210 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func renderConfig() VolumePopulatorConfig {
+	return VolumePopulatorConfig{
+		ImageName: "test-image",
+		Namespace: testVpWorkingNamespace,
+		Prefix:    testPrefix,
+		Gk:        schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind},
+		Gvr: schema.GroupVersionResource{
+			Group:    testApiGroup,
+			Version:  "v1alpha1",
+			Resource: "testdatasources",
+		},
+		PopulatorArgs: func(b bool, u *unstructured.Unstructured) ([]string, error) {
+			return []string{"--source=" + u.GetName()}, nil
+		},
+	}
+}
+
+func TestRenderMatchesController(t *testing.T) {
+	cfg := renderConfig()
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	c, _ := initSyncTest(t, claim, ust(), sc())
+	ds := c.dataSources[cfg.Gk]
+	ds.imageName = cfg.ImageName
+	ds.populatorArgs = cfg.PopulatorArgs
+
+	if err := syncTestPvc(c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pod, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pod failed: %v", err)
+	}
+	pvcPrime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get PVC' failed: %v", err)
+	}
+
+	objects, err := Render(cfg, claim, sc(), ust())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	objects.Pod.TypeMeta = metav1.TypeMeta{}
+	objects.PvcPrime.TypeMeta = metav1.TypeMeta{}
+	if !reflect.DeepEqual(objects.Pod, pod) {
+		t.Errorf("Expected pod %+v, got %+v", pod, objects.Pod)
+	}
+	if !reflect.DeepEqual(objects.PvcPrime, pvcPrime) {
+		t.Errorf("Expected PVC' %+v, got %+v", pvcPrime, objects.PvcPrime)
+	}
+}
+
+func TestRender(t *testing.T) {
+	immediate := func() *storagev1.StorageClass {
+		class := sc()
+		mode := storagev1.VolumeBindingImmediate
+		class.VolumeBindingMode = &mode
+		return class
+	}
+
+	tests := []struct {
+		name         string
+		mutate       func(cfg *VolumePopulatorConfig)
+		nodeName     string
+		storageClass *storagev1.StorageClass
+		source       *unstructured.Unstructured
+		expectErr    bool
+		expectPod    bool
+		expectNode   string
+	}{
+		{
+			name:         "Wait for first consumer",
+			nodeName:     testNodeName,
+			storageClass: sc(),
+			expectPod:    true,
+			expectNode:   testNodeName,
+		},
+		{
+			name:         "Immediate binding",
+			storageClass: immediate(),
+			expectPod:    true,
+		},
+		{
+			name:         "No selected node",
+			storageClass: sc(),
+			expectErr:    true,
+		},
+		{
+			name:      "Missing StorageClass",
+			nodeName:  testNodeName,
+			expectErr: true,
+		},
+		{
+			name: "Provider functions",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.ImageName = ""
+				cfg.PopulatorArgs = nil
+				cfg.ProviderFunctionConfig = (&fakeProvider{}).config()
+			},
+			storageClass: immediate(),
+		},
+		{
+			name: "Pod mutator",
+			mutate: func(cfg *VolumePopulatorConfig) {
+				cfg.PodMutator = func(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim, source *unstructured.Unstructured) error {
+					pod.Spec.ServiceAccountName = "populator"
+					return nil
+				}
+			},
+			storageClass: immediate(),
+			expectPod:    true,
+		},
+		{
+			name:         "Other data source",
+			storageClass: immediate(),
+			source: func() *unstructured.Unstructured {
+				source := ust()
+				source.SetName("other")
+				return source
+			}(),
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := renderConfig()
+			if test.mutate != nil {
+				test.mutate(&cfg)
+			}
+			claim := pvc(testPvcName, testPvcNamespace, test.nodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			source := test.source
+			if source == nil {
+				source = ust()
+			}
+
+			objects, err := Render(cfg, claim, test.storageClass, source)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", objects)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if objects.PvcPrime.Name != testPopulatorPvcName || objects.PvcPrime.Namespace != testVpWorkingNamespace {
+				t.Errorf("Expected PVC' %s/%s, got %s/%s", testVpWorkingNamespace, testPopulatorPvcName,
+					objects.PvcPrime.Namespace, objects.PvcPrime.Name)
+			}
+			if node := objects.PvcPrime.Annotations[annSelectedNode]; node != test.expectNode {
+				t.Errorf("Expected PVC' on node %q, got %q", test.expectNode, node)
+			}
+			if !test.expectPod {
+				if objects.Pod != nil {
+					t.Errorf("Expected no pod, got %+v", objects.Pod)
+				}
+				if _, ok := objects.PvcPrime.Annotations[testPrefix+"/"+populatedFromUIDAnnoSuffix]; !ok {
+					t.Errorf("Expected PVC' to record the data source, got annotations %v", objects.PvcPrime.Annotations)
+				}
+				return
+			}
+			if objects.Pod == nil {
+				t.Fatalf("Expected a pod")
+			}
+			if objects.Pod.Name != testPodName || objects.Pod.Spec.NodeName != test.expectNode {
+				t.Errorf("Expected pod %s on node %q, got %s on node %q", testPodName, test.expectNode,
+					objects.Pod.Name, objects.Pod.Spec.NodeName)
+			}
+			if args := objects.Pod.Spec.Containers[0].Args; !reflect.DeepEqual(args, []string{"--source=" + testDataSourceName}) {
+				t.Errorf("Unexpected args %v", args)
+			}
+			if cfg.PodMutator != nil && objects.Pod.Spec.ServiceAccountName != "populator" {
+				t.Errorf("Expected the pod mutator to be applied")
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+const (
+	populateAttemptsAnnoSuffix      = "populate-attempts"
+	populateLastFailureAnnoSuffix   = "populate-last-failure"
+	populateFailedAttemptAnnoSuffix = "populate-failed-attempt"
+	populateFailedAnnoSuffix        = "populate-failed"
+
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// RetryPolicy controls how often a failed population is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, populator pods or runs of the
+	// provider functions, that may fail before the population is given up.
+	// Zero means retry forever.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles with every
+	// further failure, up to MaxBackoff. Zero means retry immediately.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries. Defaults to 5m.
+	MaxBackoff time.Duration
+}
+
+func (r *RetryPolicy) setDefaults() {
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = defaultMaxBackoff
+	}
+}
+
+func (r *RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must not be negative")
+	}
+	if r.Backoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	return nil
+}
+
+// enabled returns true if failures need to be tracked at all.
+func (r *RetryPolicy) enabled() bool {
+	return r.MaxAttempts > 0 || r.Backoff > 0
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// failed attempts.
+func (r *RetryPolicy) backoff(attempts int) time.Duration {
+	if r.Backoff <= 0 || attempts <= 0 {
+		return 0
+	}
+	d := r.Backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	if d > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return d
+}
+
+// retryState is the failure history of a population, stored as annotations
+// on the PVC so that it survives controller restarts.
+type retryState struct {
+	attempts    int
+	lastFailure time.Time
+	// failedAttempt is the UID of the pod or PVC' of the last failed
+	// attempt, so that it is counted only once
+	failedAttempt types.UID
+	failed        bool
+	message       string
+}
+
+func (c *controller) getRetryState(pvc *corev1.PersistentVolumeClaim) retryState {
+	var state retryState
+	if v, ok := pvc.Annotations[c.attemptsAnno]; ok {
+		state.attempts, _ = strconv.Atoi(v)
+	}
+	if v, ok := pvc.Annotations[c.lastFailureAnno]; ok {
+		state.lastFailure, _ = time.Parse(time.RFC3339, v)
+	}
+	state.failedAttempt = types.UID(pvc.Annotations[c.failedAttemptAnno])
+	state.message, state.failed = pvc.Annotations[c.failedAnno]
+	return state
+}
+
+// readRetryState reads the failure history from the API server rather than
+// our lister, which may not have seen the failure we recorded last.
+func (c *controller) readRetryState(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (*corev1.PersistentVolumeClaim, retryState, error) {
+	pvc, err := c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, retryState{}, err
+	}
+	return pvc, c.getRetryState(pvc), nil
+}
+
+// waitForRetry returns true if the next attempt to populate the PVC has to
+// wait, because the population failed for good or the backoff after the last
+// failure isn't over yet. In the latter case the PVC is synced again when it
+// is.
+func (c *controller) waitForRetry(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim,
+	retryPolicy RetryPolicy,
+) (*corev1.PersistentVolumeClaim, bool, error) {
+	if !retryPolicy.enabled() {
+		return pvc, false, nil
+	}
+	pvc, state, err := c.readRetryState(ctx, pvc)
+	if err != nil {
+		return nil, false, err
+	}
+	if state.failed {
+		return pvc, true, nil
+	}
+	if delay := retryPolicy.backoff(state.attempts) - time.Since(state.lastFailure); delay > 0 {
+		// We'll get called again later when the backoff is over
+		c.workqueue.AddAfter(key, delay)
+		return pvc, true, nil
+	}
+	return pvc, false, nil
+}
+
+// setRetryState patches the failure history onto the PVC, and removes the
+// progress of the failed attempt.
+func (c *controller) setRetryState(ctx context.Context, pvc *corev1.PersistentVolumeClaim, state retryState) error {
+	annotations := map[string]interface{}{}
+	if state.attempts > 0 {
+		annotations[c.attemptsAnno] = strconv.Itoa(state.attempts)
+	}
+	if !state.lastFailure.IsZero() {
+		annotations[c.lastFailureAnno] = state.lastFailure.UTC().Format(time.RFC3339)
+	}
+	if state.failedAttempt != "" {
+		annotations[c.failedAttemptAnno] = string(state.failedAttempt)
+	}
+	if state.failed {
+		annotations[c.failedAnno] = state.message
+	}
+	if _, ok := pvc.Annotations[c.progressAnno]; ok {
+		// Progress is reported per attempt
+		annotations[c.progressAnno] = nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
+
+// clearRetryState removes the given failure history and progress annotations
+// from the PVC, if it has any of them.
+func (c *controller) clearRetryState(ctx context.Context, pvc *corev1.PersistentVolumeClaim, keys ...string) error {
+	annotations := map[string]interface{}{}
+	for _, key := range keys {
+		if _, ok := pvc.Annotations[key]; ok {
+			annotations[key] = nil
+		}
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+		expected time.Duration
+	}{
+		{
+			name:     "No backoff",
+			policy:   RetryPolicy{MaxBackoff: defaultMaxBackoff},
+			attempts: 3,
+			expected: 0,
+		},
+		{
+			name:     "No failures yet",
+			policy:   RetryPolicy{Backoff: time.Second, MaxBackoff: defaultMaxBackoff},
+			attempts: 0,
+			expected: 0,
+		},
+		{
+			name:     "First retry",
+			policy:   RetryPolicy{Backoff: time.Second, MaxBackoff: defaultMaxBackoff},
+			attempts: 1,
+			expected: time.Second,
+		},
+		{
+			name:     "Exponential",
+			policy:   RetryPolicy{Backoff: time.Second, MaxBackoff: defaultMaxBackoff},
+			attempts: 4,
+			expected: 8 * time.Second,
+		},
+		{
+			name:     "Capped",
+			policy:   RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second},
+			attempts: 10,
+			expected: 5 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.policy.backoff(test.attempts); got != test.expected {
+				t.Errorf("Expected backoff %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSyncPvcRetry(t *testing.T) {
+	attemptsAnno := testPrefix + "/" + populateAttemptsAnnoSuffix
+	lastFailureAnno := testPrefix + "/" + populateLastFailureAnnoSuffix
+	failedAnno := testPrefix + "/" + populateFailedAnnoSuffix
+	finalizer := testPrefix + "/" + pvcFinalizerSuffix
+
+	tests := []struct {
+		name        string
+		policy      RetryPolicy
+		override    func(*unstructured.Unstructured) *RetryPolicy
+		annotations map[string]string
+		// released PVCs don't have the finalizer of an ongoing population
+		released bool
+		podPhase corev1.PodPhase
+		// Expected state after the sync
+		expectAttempts string
+		expectFailed   bool
+		expectPod      bool
+		expectPvcPrime bool
+	}{
+		{
+			name:           "Failed pod is retried",
+			policy:         RetryPolicy{MaxAttempts: 3},
+			podPhase:       corev1.PodFailed,
+			expectAttempts: "1",
+			expectPvcPrime: true,
+		},
+		{
+			name:           "Retries exhausted",
+			policy:         RetryPolicy{MaxAttempts: 3},
+			annotations:    map[string]string{attemptsAnno: "2"},
+			podPhase:       corev1.PodFailed,
+			expectAttempts: "3",
+			expectFailed:   true,
+		},
+		{
+			name:   "Per data source override",
+			policy: RetryPolicy{MaxAttempts: 3},
+			override: func(u *unstructured.Unstructured) *RetryPolicy {
+				return &RetryPolicy{MaxAttempts: 1}
+			},
+			podPhase:       corev1.PodFailed,
+			expectAttempts: "1",
+			expectFailed:   true,
+		},
+		{
+			name:   "Wait for backoff before creating a new pod",
+			policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Hour},
+			annotations: map[string]string{
+				attemptsAnno:    "1",
+				lastFailureAnno: time.Now().UTC().Format(time.RFC3339),
+			},
+			expectAttempts: "1",
+			expectPvcPrime: true,
+		},
+		{
+			name:   "Create a new pod after backoff",
+			policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Second},
+			annotations: map[string]string{
+				attemptsAnno:    "1",
+				lastFailureAnno: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+			},
+			expectAttempts: "1",
+			expectPod:      true,
+			expectPvcPrime: true,
+		},
+		{
+			name:   "Ignore failed PVCs",
+			policy: RetryPolicy{MaxAttempts: 3},
+			annotations: map[string]string{
+				attemptsAnno: "3",
+				failedAnno:   "populator failed 3 times",
+			},
+			released:       true,
+			expectAttempts: "3",
+			expectFailed:   true,
+			expectPvcPrime: true,
+		},
+		{
+			name:   "Restart after the failed annotation is removed",
+			policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Hour},
+			annotations: map[string]string{
+				attemptsAnno:    "3",
+				lastFailureAnno: time.Now().UTC().Format(time.RFC3339),
+			},
+			released:       true,
+			expectAttempts: "",
+			expectPod:      true,
+			expectPvcPrime: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := populatingPvc()
+			if test.released {
+				claim = pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+					dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			}
+			for k, v := range test.annotations {
+				claim.Annotations[k] = v
+			}
+			pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+			objects := []runtime.Object{claim, pvcPrime, ust(), sc()}
+			if test.podPhase != "" {
+				objects = append(objects, pod(test.podPhase))
+			}
+			c, _ := initSyncTest(t, objects...)
+			test.policy.setDefaults()
+			c.retryPolicy = test.policy
+			c.retryPolicyOverride = test.override
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if attempts := got.Annotations[attemptsAnno]; attempts != test.expectAttempts {
+				t.Errorf("Expected %q attempts, got %q", test.expectAttempts, attempts)
+			}
+			if _, ok := got.Annotations[lastFailureAnno]; ok && test.expectAttempts == "" {
+				t.Errorf("Expected no last failure, got %q", got.Annotations[lastFailureAnno])
+			}
+			if _, failed := got.Annotations[failedAnno]; failed != test.expectFailed {
+				t.Errorf("Expected failed %t, got %t", test.expectFailed, failed)
+			}
+			if test.expectFailed {
+				for _, f := range got.Finalizers {
+					if f == finalizer {
+						t.Errorf("Expected finalizer to be removed from failed PVC")
+					}
+				}
+			}
+			_, err = c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if (err == nil) != test.expectPod {
+				t.Errorf("Expected pod %t, got error %v", test.expectPod, err)
+			}
+			_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if (err == nil) != test.expectPvcPrime {
+				t.Errorf("Expected PVC' %t, got error %v", test.expectPvcPrime, err)
+			}
+		})
+	}
+}
+
+func TestSyncPvcRetryStateCleared(t *testing.T) {
+	failureAnno := testPrefix + "/" + populateFailureAnnoSuffix
+	claim := populatingPvc()
+	claim.Annotations[testPrefix+"/"+populateAttemptsAnnoSuffix] = "2"
+	claim.Annotations[testPrefix+"/"+populateLastFailureAnnoSuffix] = time.Now().UTC().Format(time.RFC3339)
+	claim.Annotations[failureAnno] = "populator failed"
+	claim.Annotations[testPrefix+"/"+populateFailedAttemptAnnoSuffix] = "failed-pod-uid"
+	c, _ := initSyncTest(t, claim, ust(), sc(), pod(corev1.PodSucceeded),
+		pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimLost),
+		pv(testPvcName, testPvcNamespace, testPvcUid))
+
+	if err := syncTestPvc(c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pvc failed: %v", err)
+	}
+	for _, anno := range []string{
+		testPrefix + "/" + populateAttemptsAnnoSuffix,
+		testPrefix + "/" + populateLastFailureAnnoSuffix,
+		testPrefix + "/" + populateFailedAttemptAnnoSuffix,
+		failureAnno,
+	} {
+		if v, ok := got.Annotations[anno]; ok {
+			t.Errorf("Expected annotation %s to be removed, got %q", anno, v)
+		}
+	}
+	for _, f := range got.Finalizers {
+		if f == testPrefix+"/"+pvcFinalizerSuffix {
+			t.Errorf("Expected finalizer to be removed, got %v", got.Finalizers)
+		}
+	}
+}
+
+func TestSyncPvcRetryCountsFailureOnce(t *testing.T) {
+	attemptsAnno := testPrefix + "/" + populateAttemptsAnnoSuffix
+	p := pod(corev1.PodFailed)
+	p.UID = "failed-pod-uid"
+	pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+	c, recorder := initSyncTest(t, populatingPvc(), pvcPrime, p, ust(), sc())
+	c.retryPolicy = RetryPolicy{MaxAttempts: 3}
+	c.retryPolicy.setDefaults()
+
+	// The listers still show the failed pod after it was deleted, until the
+	// informers catch up
+	for i := 0; i < 2; i++ {
+		if err := syncTestPvc(c); err != nil {
+			t.Fatalf("Unexpected error in sync %d: %v", i, err)
+		}
+	}
+
+	got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pvc failed: %v", err)
+	}
+	if attempts := got.Annotations[attemptsAnno]; attempts != "1" {
+		t.Errorf("Expected one attempt, got %q", attempts)
+	}
+	if n := countEvents(recorder, reasonPodFailed); n != 1 {
+		t.Errorf("Expected one %s event, got %d", reasonPodFailed, n)
+	}
+}
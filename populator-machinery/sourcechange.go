@@ -0,0 +1,133 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DataSourceChangePolicy defines what happens when the data source of a PVC
+// is changed or deleted while the PVC is being populated.
+type DataSourceChangePolicy string
+
+const (
+	// DataSourceChangePin finishes population with the version of the data
+	// source it started with. If the data source is deleted, that version
+	// is gone for good, so population is abandoned and starts over once a
+	// data source with the same name exists again.
+	DataSourceChangePin DataSourceChangePolicy = "pin"
+	// DataSourceChangeRestart deletes the populator pod and PVC' when the
+	// generation of the data source changes, and starts over with the new
+	// version. If the data source is deleted, population starts over once
+	// it exists again.
+	DataSourceChangeRestart DataSourceChangePolicy = "restart"
+
+	reasonDataSourceChanged = "PopulatorDataSourceChanged"
+	reasonDataSourceDeleted = "PopulatorDataSourceDeleted"
+)
+
+func (p DataSourceChangePolicy) validate() error {
+	switch p {
+	case DataSourceChangePin, DataSourceChangeRestart:
+		return nil
+	}
+	return fmt.Errorf("unknown data source change policy %q", p)
+}
+
+// populationInFlight returns true if population of a PVC started and hasn't
+// finished yet.
+func (c *controller) populationInFlight(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.Spec.VolumeName == "" && hasFinalizer(pvc, c.pvcFinalizer)
+}
+
+// handleSourceDeleted is called when the data source of a PVC doesn't exist.
+func (c *controller) handleSourceDeleted(ctx context.Context, pvc *corev1.PersistentVolumeClaim, namespace string) error {
+	if !c.populationInFlight(pvc) {
+		return nil
+	}
+	dataSourceRef := pvc.Spec.DataSourceRef
+	if c.sourceChangePolicy == DataSourceChangeRestart {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonDataSourceDeleted,
+			"Data source %s/%s was deleted during population, starting over once it exists again", namespace, dataSourceRef.Name)
+	} else {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonDataSourceDeleted,
+			"Data source %s/%s was deleted during population, abandoning the population of its pinned version", namespace, dataSourceRef.Name)
+	}
+	return c.cancelPopulation(ctx, pvc)
+}
+
+// restartOnSourceChange deletes the populator pod and PVC' if the restart
+// policy is used and the data source changed since population started. The
+// version population started with is recorded on the populator pod, or on
+// PVC' without a pod. It returns true if population has to start over.
+func (c *controller) restartOnSourceChange(ctx context.Context, pvc *corev1.PersistentVolumeClaim, ds *dataSource,
+	source *unstructured.Unstructured, pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim,
+) (bool, error) {
+	if c.sourceChangePolicy != DataSourceChangeRestart {
+		return false, nil
+	}
+	if (pod != nil && pod.DeletionTimestamp != nil) || (pvcPrime != nil && pvcPrime.DeletionTimestamp != nil) {
+		// Already on its way out, for example because of an earlier restart
+		return false, nil
+	}
+	var recorded map[string]string
+	if ds.provider != nil {
+		if pvcPrime == nil {
+			return false, nil
+		}
+		recorded = pvcPrime.Annotations
+	} else {
+		if pod == nil || pod.Status.Phase == corev1.PodSucceeded {
+			// Nothing running, or population is done already
+			return false, nil
+		}
+		recorded = pod.Annotations
+	}
+	uid, uidFound := recorded[c.sourceUIDAnno]
+	generation, generationFound := recorded[c.sourceGenAnno]
+	if !uidFound || !generationFound {
+		// Started before the version was recorded
+		return false, nil
+	}
+	currentGeneration := strconv.FormatInt(source.GetGeneration(), 10)
+	if uid == string(source.GetUID()) && generation == currentGeneration {
+		return false, nil
+	}
+
+	c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonDataSourceChanged,
+		"Data source %s/%s changed from generation %s to %s, restarting population", source.GetNamespace(), source.GetName(), generation, currentGeneration)
+	if pod != nil {
+		err := c.kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	if pvcPrime != nil {
+		err := c.kubeClient.CoreV1().PersistentVolumeClaims(pvcPrime.Namespace).Delete(ctx, pvcPrime.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
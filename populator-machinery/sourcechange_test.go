@@ -0,0 +1,202 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSyncPvcSourceChanged(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        DataSourceChangePolicy
+		podPhase      corev1.PodPhase
+		recordedGen   string
+		recordedUID   string
+		deleting      bool
+		expectRestart bool
+	}{
+		{
+			name:        "Pinned",
+			policy:      DataSourceChangePin,
+			podPhase:    corev1.PodRunning,
+			recordedGen: "1",
+			recordedUID: "source-uid",
+		},
+		{
+			name:        "Restart, unchanged",
+			policy:      DataSourceChangeRestart,
+			podPhase:    corev1.PodRunning,
+			recordedGen: "2",
+			recordedUID: "source-uid",
+		},
+		{
+			name:          "Restart, generation changed",
+			policy:        DataSourceChangeRestart,
+			podPhase:      corev1.PodRunning,
+			recordedGen:   "1",
+			recordedUID:   "source-uid",
+			expectRestart: true,
+		},
+		{
+			name:          "Restart, recreated",
+			policy:        DataSourceChangeRestart,
+			podPhase:      corev1.PodRunning,
+			recordedGen:   "2",
+			recordedUID:   "old-source-uid",
+			expectRestart: true,
+		},
+		{
+			name:        "Restart, pod already deleted",
+			policy:      DataSourceChangeRestart,
+			podPhase:    corev1.PodRunning,
+			recordedGen: "1",
+			recordedUID: "source-uid",
+			deleting:    true,
+		},
+		{
+			name:        "Restart, population finished",
+			policy:      DataSourceChangeRestart,
+			podPhase:    corev1.PodSucceeded,
+			recordedGen: "1",
+			recordedUID: "source-uid",
+		},
+		{
+			name:     "Restart, nothing recorded",
+			policy:   DataSourceChangeRestart,
+			podPhase: corev1.PodRunning,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+			p := pod(test.podPhase)
+			if test.recordedGen != "" {
+				p.Annotations = map[string]string{
+					testPrefix + "/" + populatedFromGenAnnoSuffix: test.recordedGen,
+					testPrefix + "/" + populatedFromUIDAnnoSuffix: test.recordedUID,
+				}
+			}
+			if test.deleting {
+				p.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			}
+			source := ust()
+			source.SetUID(types.UID("source-uid"))
+			source.SetGeneration(2)
+			c, recorder := initSyncTest(t, populatingPvc(), pvcPrime, p, source, sc())
+			c.sourceChangePolicy = test.policy
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expectEvents := 0
+			if test.expectRestart {
+				expectEvents = 1
+			}
+			if n := countEvents(recorder, reasonDataSourceChanged); n != expectEvents {
+				t.Errorf("Expected %d %s events, got %d", expectEvents, reasonDataSourceChanged, n)
+			}
+			_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if (err != nil) != test.expectRestart {
+				t.Errorf("Expected pod deleted %t, got error %v", test.expectRestart, err)
+			}
+			_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+			if (err != nil) != test.expectRestart {
+				t.Errorf("Expected PVC' deleted %t, got error %v", test.expectRestart, err)
+			}
+		})
+	}
+}
+
+func TestSyncPvcSourceDeleted(t *testing.T) {
+	finalizer := testPrefix + "/" + pvcFinalizerSuffix
+
+	tests := []struct {
+		name         string
+		policy       DataSourceChangePolicy
+		started      bool
+		expectEvent  bool
+		expectCancel bool
+	}{
+		{
+			name:   "Not started",
+			policy: DataSourceChangeRestart,
+		},
+		{
+			name:         "Pinned",
+			policy:       DataSourceChangePin,
+			started:      true,
+			expectEvent:  true,
+			expectCancel: true,
+		},
+		{
+			name:         "Restart",
+			policy:       DataSourceChangeRestart,
+			started:      true,
+			expectEvent:  true,
+			expectCancel: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			objects := []runtime.Object{claim}
+			if test.started {
+				objects = []runtime.Object{populatingPvc(), pod(corev1.PodRunning)}
+			}
+			c, recorder := initSyncTest(t, objects...)
+			c.sourceChangePolicy = test.policy
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expectEvents := 0
+			if test.expectEvent {
+				expectEvents = 1
+			}
+			if n := countEvents(recorder, reasonDataSourceDeleted); n != expectEvents {
+				t.Errorf("Expected %d %s events, got %d", expectEvents, reasonDataSourceDeleted, n)
+			}
+			if !test.started {
+				return
+			}
+			_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if (err != nil) != test.expectCancel {
+				t.Errorf("Expected pod deleted %t, got error %v", test.expectCancel, err)
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if hasFinalizer(got, finalizer) == test.expectCancel {
+				t.Errorf("Expected finalizer %t, got finalizers %v", !test.expectCancel, got.Finalizers)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// Phases of a population, as written to the status of the data source.
+const (
+	populationInProgress = "InProgress"
+	populationSucceeded  = "Succeeded"
+	populationFailed     = "Failed"
+)
+
+const (
+	// maxFinishedPopulations is the number of succeeded and failed
+	// populations kept in the status of a data source. The counters keep
+	// counting after older entries are dropped.
+	maxFinishedPopulations = 20
+
+	conditionPopulating = "Populating"
+
+	reasonPopulationStarted   = "PopulationStarted"
+	reasonPopulationSucceeded = "PopulationSucceeded"
+	reasonPopulationFailed    = "PopulationFailed"
+	reasonPopulationIdle      = "Idle"
+)
+
+// updateDataSourceStatus records the phase of the population of pvc in the
+// status of its data source and records an event on the data source. The
+// status is informational, so errors are only logged.
+func (c *controller) updateDataSourceStatus(ctx context.Context, ds *dataSource, source *unstructured.Unstructured,
+	pvc *corev1.PersistentVolumeClaim, phase, message string,
+) {
+	if !c.dataSourceStatus {
+		return
+	}
+	if populationPhase(source, pvc) == phase {
+		// Nothing to do, avoid reading the data source from the API server
+		return
+	}
+
+	var changed bool
+	client := c.dynClient.Resource(ds.gvr).Namespace(source.GetNamespace())
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(ctx, source.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed, err = setPopulationStatus(obj, pvc, phase, message, time.Now())
+		if err != nil || !changed {
+			return err
+		}
+		_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Errorf("Failed to update status of %s %s/%s: %v", ds.gk, source.GetNamespace(), source.GetName(), err)
+		}
+		return
+	}
+	if !changed {
+		return
+	}
+
+	switch phase {
+	case populationInProgress:
+		c.recorder.Eventf(source, corev1.EventTypeNormal, reasonPopulationStarted, "Populating PVC %s/%s", pvc.Namespace, pvc.Name)
+	case populationSucceeded:
+		c.recorder.Eventf(source, corev1.EventTypeNormal, reasonPopulationSucceeded, "Populated PVC %s/%s", pvc.Namespace, pvc.Name)
+	case populationFailed:
+		c.recorder.Eventf(source, corev1.EventTypeWarning, reasonPopulationFailed, "Failed to populate PVC %s/%s: %s", pvc.Namespace, pvc.Name, message)
+	}
+}
+
+// populationPhase returns the phase of the population of pvc in the status of
+// the data source, or an empty string if there is none.
+func populationPhase(source *unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim) string {
+	populations, _, _ := unstructured.NestedSlice(source.Object, "status", "populations")
+	for _, p := range populations {
+		if entry, ok := p.(map[string]interface{}); ok && entry["uid"] == string(pvc.UID) {
+			phase, _ := entry["phase"].(string)
+			return phase
+		}
+	}
+	return ""
+}
+
+// setPopulationStatus sets the phase of the population of pvc in the status of
+// the data source, and updates the counters and conditions accordingly. It
+// returns false if the status was already up to date.
+//
+// The status looks like:
+//
+//	status:
+//	  inProgress: 1
+//	  succeeded: 4
+//	  failed: 0
+//	  populations:
+//	  - namespace: default
+//	    name: my-pvc
+//	    uid: ...
+//	    phase: InProgress
+//	    lastTransitionTime: "2024-01-01T00:00:00Z"
+//	  conditions:
+//	  - type: Populating
+//	    status: "True"
+//	    ...
+func setPopulationStatus(obj *unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim, phase, message string, now time.Time) (bool, error) {
+	populations, _, err := unstructured.NestedSlice(obj.Object, "status", "populations")
+	if err != nil {
+		return false, fmt.Errorf("invalid populations in status: %v", err)
+	}
+
+	var entry map[string]interface{}
+	for _, p := range populations {
+		if e, ok := p.(map[string]interface{}); ok && e["uid"] == string(pvc.UID) {
+			entry = e
+			break
+		}
+	}
+	if entry != nil && entry["phase"] == phase {
+		return false, nil
+	}
+	if entry == nil {
+		entry = map[string]interface{}{
+			"namespace": pvc.Namespace,
+			"name":      pvc.Name,
+			"uid":       string(pvc.UID),
+		}
+		populations = append(populations, entry)
+	}
+	entry["phase"] = phase
+	entry["lastTransitionTime"] = now.UTC().Format(time.RFC3339)
+	if message != "" {
+		entry["message"] = message
+	} else {
+		delete(entry, "message")
+	}
+
+	switch phase {
+	case populationSucceeded, populationFailed:
+		counter := "succeeded"
+		if phase == populationFailed {
+			counter = "failed"
+		}
+		count, _, _ := unstructured.NestedInt64(obj.Object, "status", counter)
+		if err := unstructured.SetNestedField(obj.Object, count+1, "status", counter); err != nil {
+			return false, err
+		}
+	}
+
+	populations = trimFinishedPopulations(populations)
+	var inProgress int64
+	for _, p := range populations {
+		if e, ok := p.(map[string]interface{}); ok && e["phase"] == populationInProgress {
+			inProgress++
+		}
+	}
+	if err := unstructured.SetNestedSlice(obj.Object, populations, "status", "populations"); err != nil {
+		return false, err
+	}
+	if err := unstructured.SetNestedField(obj.Object, inProgress, "status", "inProgress"); err != nil {
+		return false, err
+	}
+
+	condition := map[string]interface{}{
+		"type":   conditionPopulating,
+		"status": string(metav1.ConditionFalse),
+		"reason": reasonPopulationIdle,
+	}
+	if inProgress > 0 {
+		condition["status"] = string(metav1.ConditionTrue)
+		condition["reason"] = reasonPopulationStarted
+		condition["message"] = fmt.Sprintf("%d populations in progress", inProgress)
+	}
+	return true, setCondition(obj, condition, now)
+}
+
+// trimFinishedPopulations drops the oldest succeeded and failed populations
+// beyond maxFinishedPopulations.
+func trimFinishedPopulations(populations []interface{}) []interface{} {
+	finished := 0
+	for _, p := range populations {
+		if e, ok := p.(map[string]interface{}); ok && e["phase"] != populationInProgress {
+			finished++
+		}
+	}
+	trimmed := make([]interface{}, 0, len(populations))
+	for _, p := range populations {
+		if e, ok := p.(map[string]interface{}); ok && e["phase"] != populationInProgress && finished > maxFinishedPopulations {
+			finished--
+			continue
+		}
+		trimmed = append(trimmed, p)
+	}
+	return trimmed
+}
+
+// setCondition sets a condition in the status of obj, keeping its
+// lastTransitionTime unless the condition status changed.
+func setCondition(obj *unstructured.Unstructured, condition map[string]interface{}, now time.Time) error {
+	conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil {
+		return fmt.Errorf("invalid conditions in status: %v", err)
+	}
+	condition["lastTransitionTime"] = now.UTC().Format(time.RFC3339)
+	found := false
+	for i, c := range conditions {
+		existing, ok := c.(map[string]interface{})
+		if !ok || existing["type"] != condition["type"] {
+			continue
+		}
+		if existing["status"] == condition["status"] && existing["lastTransitionTime"] != nil {
+			condition["lastTransitionTime"] = existing["lastTransitionTime"]
+		}
+		conditions[i] = condition
+		found = true
+	}
+	if !found {
+		conditions = append(conditions, condition)
+	}
+	return unstructured.SetNestedSlice(obj.Object, conditions, "status", "conditions")
+}
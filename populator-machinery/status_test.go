@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func checkPopulationCounts(t *testing.T, obj *unstructured.Unstructured, inProgress, succeeded, failed int64) {
+	t.Helper()
+	for field, expected := range map[string]int64{"inProgress": inProgress, "succeeded": succeeded, "failed": failed} {
+		got, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		if got != expected {
+			t.Errorf("Expected %s %d, got %d", field, expected, got)
+		}
+	}
+}
+
+func populatingCondition(obj *unstructured.Unstructured) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		if condition := c.(map[string]interface{}); condition["type"] == conditionPopulating {
+			return condition
+		}
+	}
+	return nil
+}
+
+func TestSetPopulationStatus(t *testing.T) {
+	obj := ust()
+	claim := pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", nil, "")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	changed, err := setPopulationStatus(obj, claim, populationInProgress, "", start)
+	if err != nil || !changed {
+		t.Fatalf("Expected status to change, got %t, %v", changed, err)
+	}
+	checkPopulationCounts(t, obj, 1, 0, 0)
+	if phase := populationPhase(obj, claim); phase != populationInProgress {
+		t.Errorf("Expected phase %s, got %s", populationInProgress, phase)
+	}
+	if condition := populatingCondition(obj); condition["status"] != string(metav1.ConditionTrue) {
+		t.Errorf("Expected %s condition to be true, got %v", conditionPopulating, condition)
+	}
+
+	changed, err = setPopulationStatus(obj, claim, populationInProgress, "", start.Add(time.Minute))
+	if err != nil || changed {
+		t.Errorf("Expected status to be up to date, got %t, %v", changed, err)
+	}
+
+	end := start.Add(time.Hour)
+	changed, err = setPopulationStatus(obj, claim, populationSucceeded, "", end)
+	if err != nil || !changed {
+		t.Fatalf("Expected status to change, got %t, %v", changed, err)
+	}
+	checkPopulationCounts(t, obj, 0, 1, 0)
+	condition := populatingCondition(obj)
+	if condition["status"] != string(metav1.ConditionFalse) || condition["lastTransitionTime"] != end.Format(time.RFC3339) {
+		t.Errorf("Expected %s condition to be false since %s, got %v", conditionPopulating, end, condition)
+	}
+
+	// Only the latest finished populations are kept, but all are counted
+	for i := 0; i < maxFinishedPopulations+5; i++ {
+		other := claim.DeepCopy()
+		other.UID = types.UID(fmt.Sprintf("uid-%d", i))
+		if _, err := setPopulationStatus(obj, other, populationFailed, "populator failed", end); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkPopulationCounts(t, obj, 0, 1, maxFinishedPopulations+5)
+	populations, _, _ := unstructured.NestedSlice(obj.Object, "status", "populations")
+	if len(populations) != maxFinishedPopulations {
+		t.Errorf("Expected %d populations, got %d", maxFinishedPopulations, len(populations))
+	}
+	if phase := populationPhase(obj, claim); phase != "" {
+		t.Errorf("Expected oldest population to be dropped, got phase %s", phase)
+	}
+}
+
+func TestSyncPvcDataSourceStatus(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: testApiGroup, Version: "v1alpha1", Resource: "testdatasources"}
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		pod           *corev1.Pod
+		expectPhase   string
+		expectReason  string
+		expectFailed  int64
+		expectRunning int64
+	}{
+		{
+			name: "Disabled",
+		},
+		{
+			name:          "Population started",
+			enabled:       true,
+			expectPhase:   populationInProgress,
+			expectReason:  reasonPopulationStarted,
+			expectRunning: 1,
+		},
+		{
+			name:         "Population failed",
+			enabled:      true,
+			pod:          pod(corev1.PodFailed),
+			expectPhase:  populationFailed,
+			expectReason: reasonPopulationFailed,
+			expectFailed: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+				dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+			objects := []runtime.Object{claim, ust(), sc()}
+			if test.pod != nil {
+				objects = append(objects, test.pod)
+			}
+			c, recorder := initSyncTest(t, objects...)
+			c.dataSourceStatus = test.enabled
+			c.retryPolicy = RetryPolicy{MaxAttempts: 1}
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, err := c.dynClient.Resource(gvr).Namespace(testPvcNamespace).Get(context.TODO(), testDataSourceName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get data source failed: %v", err)
+			}
+			if phase := populationPhase(got, claim); phase != test.expectPhase {
+				t.Errorf("Expected phase %q, got %q", test.expectPhase, phase)
+			}
+			if test.enabled {
+				checkPopulationCounts(t, got, test.expectRunning, 0, test.expectFailed)
+			}
+			if test.expectReason != "" {
+				if n := countEvents(recorder, test.expectReason); n != 1 {
+					t.Errorf("Expected one %s event, got %d", test.expectReason, n)
+				}
+			}
+		})
+	}
+}
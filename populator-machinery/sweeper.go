@@ -0,0 +1,181 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultSweepInterval    = 10 * time.Minute
+	defaultSweepGracePeriod = 10 * time.Minute
+
+	pvcUIDIndex = "pvcUID"
+
+	orphanDeleted = "deleted"
+	orphanDryRun  = "dry-run"
+	orphanError   = "error"
+
+	reasonOrphanFound   = "PopulatorOrphanFound"
+	reasonOrphanDeleted = "PopulatorOrphanDeleted"
+)
+
+// OrphanSweeperConfig configures the garbage collection of populator pods and
+// PVC' objects whose PVC doesn't exist anymore, for example because the PVC
+// was deleted during population or the controller crashed.
+type OrphanSweeperConfig struct {
+	// Enabled starts the sweeper. It runs once the caches are synced and
+	// then every Interval.
+	Enabled bool
+	// Interval is the time between two sweeps. Defaults to 10m.
+	Interval time.Duration
+	// GracePeriod is how old a pod or PVC' has to be before it is deleted,
+	// so that objects whose PVC isn't in the cache yet are kept. Defaults
+	// to 10m.
+	GracePeriod time.Duration
+	// DryRun only logs and records events for orphans instead of deleting
+	// them.
+	DryRun bool
+}
+
+func (s *OrphanSweeperConfig) setDefaults() {
+	if s.Interval == 0 {
+		s.Interval = defaultSweepInterval
+	}
+	if s.GracePeriod == 0 {
+		s.GracePeriod = defaultSweepGracePeriod
+	}
+}
+
+func (s *OrphanSweeperConfig) validate() error {
+	if s.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if s.GracePeriod < 0 {
+		return fmt.Errorf("grace period must not be negative")
+	}
+	return nil
+}
+
+// pvcUIDIndexFunc indexes PVCs by UID, so that the owner of a populator pod
+// or PVC' can be found.
+func pvcUIDIndexFunc(obj interface{}) ([]string, error) {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return nil, nil
+	}
+	return []string{string(pvc.UID)}, nil
+}
+
+// sweepOrphans deletes the populator pods and PVC' objects in the populator
+// namespace whose PVC doesn't exist.
+func (c *controller) sweepOrphans(ctx context.Context) {
+	pods, err := c.podLister.Pods(c.populatorNamespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list populator pods: %v", err)
+		return
+	}
+	for _, pod := range pods {
+		if !c.isOrphan(&pod.ObjectMeta, populatorPodPrefix) {
+			continue
+		}
+		c.deleteOrphan(ctx, resourcePod, pod, &pod.ObjectMeta, func(opts metav1.DeleteOptions) error {
+			return c.kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, opts)
+		})
+	}
+
+	pvcs, err := c.pvcLister.PersistentVolumeClaims(c.populatorNamespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list populator PVCs: %v", err)
+		return
+	}
+	for _, pvc := range pvcs {
+		if !c.isOrphan(&pvc.ObjectMeta, populatorPvcPrefix) {
+			continue
+		}
+		c.deleteOrphan(ctx, resourcePVC, pvc, &pvc.ObjectMeta, func(opts metav1.DeleteOptions) error {
+			return c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, opts)
+		})
+	}
+}
+
+// isOrphan returns true if an object is a populator pod or PVC' older than the
+// grace period whose PVC doesn't exist. The PVC UID is taken from the labels,
+// or from the name for objects created before they were labelled. Names that
+// don't end with a UID weren't generated by us, for example prime-data.
+func (c *controller) isOrphan(meta *metav1.ObjectMeta, namePrefix string) bool {
+	if meta.DeletionTimestamp != nil {
+		return false
+	}
+	if managedBy, ok := meta.Labels[managedByLabel]; ok && managedBy != c.prefix+"-"+controllerNameSuffix {
+		// Belongs to another populator sharing the namespace
+		return false
+	}
+	uid, ok := meta.Labels[c.prefix+"/"+pvcUIDLabelSuffix]
+	if !ok {
+		uid, ok = strings.CutPrefix(meta.Name, namePrefix+"-")
+		if !ok {
+			return false
+		}
+		if _, err := uuid.Parse(uid); err != nil {
+			return false
+		}
+	}
+	if time.Since(meta.CreationTimestamp.Time) < c.sweeper.GracePeriod {
+		return false
+	}
+	owners, err := c.pvcIndexer.ByIndex(pvcUIDIndex, uid)
+	if err != nil {
+		klog.Errorf("Failed to look up PVC %s: %v", uid, err)
+		return false
+	}
+	return len(owners) == 0
+}
+
+// deleteOrphan deletes an orphaned populator pod or PVC', unless the sweeper
+// runs in dry-run mode.
+func (c *controller) deleteOrphan(ctx context.Context, resource string, obj runtime.Object, meta *metav1.ObjectMeta,
+	deleteFunc func(metav1.DeleteOptions) error,
+) {
+	if c.sweeper.DryRun {
+		klog.Infof("Found orphaned populator %s %s/%s, not deleting it in dry-run mode", resource, meta.Namespace, meta.Name)
+		c.recorder.Eventf(obj, corev1.EventTypeNormal, reasonOrphanFound, "The PVC this %s was created for doesn't exist", resource)
+		c.metrics.recordOrphan(resource, orphanDryRun)
+		return
+	}
+	// Don't delete a newer object with the same name
+	err := deleteFunc(metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &meta.UID}})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("Failed to delete orphaned populator %s %s/%s: %v", resource, meta.Namespace, meta.Name, err)
+		c.metrics.recordOrphan(resource, orphanError)
+		return
+	}
+	klog.Infof("Deleted orphaned populator %s %s/%s", resource, meta.Namespace, meta.Name)
+	c.recorder.Eventf(obj, corev1.EventTypeNormal, reasonOrphanDeleted, "Deleted because the PVC this %s was created for doesn't exist", resource)
+	c.metrics.recordOrphan(resource, orphanDeleted)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestSweepOrphans(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-time.Hour))
+	labelled := map[string]string{
+		managedByLabel:                       testPrefix + "-" + controllerNameSuffix,
+		testPrefix + "/" + pvcUIDLabelSuffix: testPvcUid,
+	}
+
+	tests := []struct {
+		name      string
+		pvcExists bool
+		created   metav1.Time
+		labels    map[string]string
+		// Suffix of the object names, the PVC UID by default
+		nameSuffix    string
+		dryRun        bool
+		expectDeleted bool
+		expectReason  string
+	}{
+		{
+			name:          "Orphan",
+			created:       old,
+			labels:        labelled,
+			expectDeleted: true,
+			expectReason:  reasonOrphanDeleted,
+		},
+		{
+			name:          "Unlabelled orphan",
+			created:       old,
+			nameSuffix:    "0b5d6b8e-6a4c-4a57-9f6e-3f1c2d7c9a10",
+			expectDeleted: true,
+			expectReason:  reasonOrphanDeleted,
+		},
+		{
+			name:       "Unlabelled with a name that isn't ours",
+			created:    old,
+			nameSuffix: "data",
+		},
+		{
+			name:      "PVC exists",
+			pvcExists: true,
+			created:   old,
+			labels:    labelled,
+		},
+		{
+			name:    "Within grace period",
+			created: metav1.Now(),
+			labels:  labelled,
+		},
+		{
+			name:         "Dry run",
+			created:      old,
+			labels:       labelled,
+			dryRun:       true,
+			expectReason: reasonOrphanFound,
+		},
+		{
+			name:    "Other populator",
+			created: old,
+			labels:  map[string]string{managedByLabel: "other-populator"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podName, pvcPrimeName := testPodName, testPopulatorPvcName
+			if test.nameSuffix != "" {
+				podName = populatorPodPrefix + "-" + test.nameSuffix
+				pvcPrimeName = populatorPvcPrefix + "-" + test.nameSuffix
+			}
+			p := pod(corev1.PodRunning)
+			p.Name = podName
+			p.CreationTimestamp = test.created
+			p.Labels = test.labels
+			pvcPrime := pvc(pvcPrimeName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+			pvcPrime.UID = "prime-uid"
+			pvcPrime.CreationTimestamp = test.created
+			pvcPrime.Labels = test.labels
+			objects := []runtime.Object{p, pvcPrime}
+			if test.pvcExists {
+				objects = append(objects, pvc(testPvcName, testPvcNamespace, "", testStorageClassName, "", nil, ""))
+			}
+			c, recorder := initSyncTest(t, objects...)
+			c.sweeper = OrphanSweeperConfig{Enabled: true, GracePeriod: 10 * time.Minute, DryRun: test.dryRun}
+
+			c.sweepOrphans(context.TODO())
+
+			_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), podName, metav1.GetOptions{})
+			if (err != nil) != test.expectDeleted {
+				t.Errorf("Expected pod deleted %t, got error %v", test.expectDeleted, err)
+			}
+			_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), pvcPrimeName, metav1.GetOptions{})
+			if (err != nil) != test.expectDeleted {
+				t.Errorf("Expected PVC' deleted %t, got error %v", test.expectDeleted, err)
+			}
+			if test.expectReason == "" {
+				if n := len(recorder.Events); n != 0 {
+					t.Errorf("Expected no events, got %d", n)
+				}
+				return
+			}
+			// One for the pod and one for PVC'
+			if n := countEvents(recorder, test.expectReason); n != 2 {
+				t.Errorf("Expected 2 %s events, got %d", test.expectReason, n)
+			}
+		})
+	}
+}
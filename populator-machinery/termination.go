@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+)
+
+const (
+	populateFailureAnnoSuffix = "populate-failure"
+
+	// maxFailureMessageLength bounds the failure details put into events and
+	// annotations.
+	maxFailureMessageLength = 1024
+	// maxFailureLogBytes bounds the log tail read from a failed pod.
+	maxFailureLogBytes = 4096
+)
+
+// podFailureMessage describes why the populator pod failed, using the exit code,
+// reason and termination message of the populate container if available, and
+// optionally the tail of its logs.
+func (c *controller) podFailureMessage(ctx context.Context, pod *corev1.Pod) string {
+	var parts []string
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != populatorContainerName || status.State.Terminated == nil {
+			continue
+		}
+		terminated := status.State.Terminated
+		parts = append(parts, fmt.Sprintf("exit code %d", terminated.ExitCode))
+		if terminated.Reason != "" {
+			parts = append(parts, "reason "+terminated.Reason)
+		}
+		if msg := strings.TrimSpace(terminated.Message); msg != "" {
+			parts = append(parts, "message: "+msg)
+		}
+	}
+	if len(parts) == 0 && pod.Status.Message != "" {
+		parts = append(parts, pod.Status.Message)
+	}
+	if c.failureLogLines > 0 {
+		if logs := c.podLogTail(ctx, pod); logs != "" {
+			parts = append(parts, "logs: "+logs)
+		}
+	}
+	if len(parts) == 0 {
+		return "unknown reason"
+	}
+	return truncate(strings.Join(parts, ", "), maxFailureMessageLength)
+}
+
+// podLogTail returns the last lines of the populate container's logs, or an
+// empty string if they cannot be read.
+func (c *controller) podLogTail(ctx context.Context, pod *corev1.Pod) string {
+	tailLines := c.failureLogLines
+	limitBytes := int64(maxFailureLogBytes)
+	req := c.kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container:  populatorContainerName,
+		TailLines:  &tailLines,
+		LimitBytes: &limitBytes,
+	})
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		klog.V(2).Infof("Failed to get logs of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return ""
+	}
+	defer stream.Close()
+	logs, err := io.ReadAll(io.LimitReader(stream, maxFailureLogBytes))
+	if err != nil {
+		klog.V(2).Infof("Failed to read logs of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return ""
+	}
+	return strings.TrimSpace(string(logs))
+}
+
+// setFailureAnnotation records the last failure on the PVC, so that users can
+// see it without access to the populator namespace.
+func (c *controller) setFailureAnnotation(ctx context.Context, pvc *corev1.PersistentVolumeClaim, message string) error {
+	if pvc.Annotations[c.failureAnno] == message {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				c.failureAnno: message,
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType,
+		data, metav1.PatchOptions{})
+	return err
+}
+
+// truncate shortens s to at most length bytes without splitting a multi-byte
+// character, so that the result stays valid UTF-8.
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	end := length - 3
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func failedPod(statuses ...corev1.ContainerStatus) *corev1.Pod {
+	p := pod(corev1.PodFailed)
+	p.Status.ContainerStatuses = statuses
+	return p
+}
+
+func terminatedStatus(name string, exitCode int32, reason, message string) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name: name,
+		State: corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{
+				ExitCode: exitCode,
+				Reason:   reason,
+				Message:  message,
+			},
+		},
+	}
+}
+
+func TestPodFailureMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		logLines int64
+		expected string
+	}{
+		{
+			name:     "Unknown reason",
+			pod:      failedPod(),
+			expected: "unknown reason",
+		},
+		{
+			name: "Pod status message",
+			pod: func() *corev1.Pod {
+				p := failedPod()
+				p.Status.Message = "Pod was evicted"
+				return p
+			}(),
+			expected: "Pod was evicted",
+		},
+		{
+			name:     "Container terminated",
+			pod:      failedPod(terminatedStatus(populatorContainerName, 2, "Error", "no space left on device\n")),
+			expected: "exit code 2, reason Error, message: no space left on device",
+		},
+		{
+			name:     "Other containers are ignored",
+			pod:      failedPod(terminatedStatus("sidecar", 1, "Error", "sidecar failed")),
+			expected: "unknown reason",
+		},
+		{
+			name:     "Log tail",
+			pod:      failedPod(terminatedStatus(populatorContainerName, 1, "Error", "")),
+			logLines: 10,
+			// The fake clientset always returns these logs
+			expected: "exit code 1, reason Error, logs: fake logs",
+		},
+		{
+			name:     "Truncated",
+			pod:      failedPod(terminatedStatus(populatorContainerName, 1, "", strings.Repeat("x", 2*maxFailureMessageLength))),
+			expected: "exit code 1, message: " + strings.Repeat("x", maxFailureMessageLength-len("exit code 1, message: ")-3) + "...",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, _, _, _, _ := initTest()
+			c.failureLogLines = test.logLines
+			if got := c.podFailureMessage(context.TODO(), test.pod); got != test.expected {
+				t.Errorf("Expected message %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		length   int
+		expected string
+	}{
+		{
+			name:     "Short",
+			s:        "short",
+			length:   10,
+			expected: "short",
+		},
+		{
+			name:     "ASCII",
+			s:        "0123456789",
+			length:   8,
+			expected: "01234...",
+		},
+		{
+			name: "Multi-byte character at the cut",
+			// "é" takes two bytes, the cut at byte 6 falls into the second one
+			s:        "abcdeéfgh",
+			length:   9,
+			expected: "abcde...",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := truncate(test.s, test.length)
+			if got != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, got)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("Expected valid UTF-8, got %q", got)
+			}
+		})
+	}
+}
+
+func TestSyncPvcFailureDetails(t *testing.T) {
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, "", nil, "")
+	p := failedPod(terminatedStatus(populatorContainerName, 3, "Error", "checksum mismatch"))
+	c, recorder := initSyncTest(t, claim, pvcPrime, p, ust(), sc())
+
+	if err := syncTestPvc(c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "exit code 3, reason Error, message: checksum mismatch"
+	got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pvc failed: %v", err)
+	}
+	if anno := got.Annotations[testPrefix+"/"+populateFailureAnnoSuffix]; anno != expected {
+		t.Errorf("Expected failure annotation %q, got %q", expected, anno)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, reasonPodFailed) || !strings.Contains(event, expected) {
+			t.Errorf("Expected %s event with %q, got %q", reasonPodFailed, expected, event)
+		}
+	default:
+		t.Errorf("Expected %s event", reasonPodFailed)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+const (
+	populationTimeoutAnnoSuffix = "population-timeout"
+
+	// podDeadlineExceeded is the reason of pods killed by the kubelet after
+	// their ActiveDeadlineSeconds.
+	podDeadlineExceeded = "DeadlineExceeded"
+
+	reasonPopulatorTimeout = "PopulatorTimeout"
+)
+
+// sourceTimeout returns how long an attempt to populate a volume from the
+// data source may take. The data source can override the configured timeout
+// with an annotation. Zero means no limit.
+func (c *controller) sourceTimeout(source *unstructured.Unstructured) time.Duration {
+	value, ok := source.GetAnnotations()[c.timeoutAnno]
+	if !ok {
+		return c.populationTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		klog.V(2).Infof("Ignoring invalid population timeout %q of data source %s/%s", value, source.GetNamespace(), source.GetName())
+		return c.populationTimeout
+	}
+	return timeout
+}
+
+// setPodDeadline lets the kubelet stop populator pods that run for longer than
+// the population timeout.
+func setPodDeadline(pod *corev1.Pod, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	seconds := int64(math.Ceil(timeout.Seconds()))
+	pod.Spec.ActiveDeadlineSeconds = &seconds
+}
+
+// handOverStarted returns true once the volume of PVC' was given to the PVC.
+// The population can't be stopped anymore then.
+func (c *controller) handOverStarted(pvc, pvcPrime *corev1.PersistentVolumeClaim) bool {
+	if pvcPrime == nil || pvcPrime.Spec.VolumeName == "" {
+		return false
+	}
+	pv, err := c.pvLister.Get(pvcPrime.Spec.VolumeName)
+	if err != nil {
+		return false
+	}
+	return pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.UID == pvc.UID
+}
+
+// checkTimeout fails the current attempt to populate a PVC if it took longer
+// than the population timeout, including the wait for PVC' to be bound. An
+// attempt starts when the populator pod is created, or PVC' with provider
+// functions. It returns true if the attempt timed out. Otherwise the PVC is
+// synced again when the timeout expires.
+func (c *controller) checkTimeout(ctx context.Context, key string, pvc *corev1.PersistentVolumeClaim, ds *dataSource,
+	source *unstructured.Unstructured, pod *corev1.Pod, pvcPrime *corev1.PersistentVolumeClaim,
+	retryPolicy RetryPolicy, metricLabels sourceLabels,
+) (bool, error) {
+	timeout := c.sourceTimeout(source)
+	if timeout == 0 {
+		return false, nil
+	}
+	var started metav1.Time
+	if ds.provider != nil {
+		if pvcPrime == nil || c.providerComplete(pvc, pvcPrime) {
+			return false, nil
+		}
+		started = pvcPrime.CreationTimestamp
+	} else {
+		if pod == nil || pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodFailed {
+			// Failed pods, including the ones stopped by their deadline, are
+			// handled like any other failure
+			return false, nil
+		}
+		if pod.Status.Phase == corev1.PodSucceeded {
+			// The data is there, only the hand over of the volume is left
+			return false, nil
+		}
+		started = pod.CreationTimestamp
+	}
+	if remaining := timeout - time.Since(started.Time); remaining > 0 {
+		c.workqueue.AddAfter(key, remaining)
+		return false, nil
+	}
+	if c.handOverStarted(pvc, pvcPrime) {
+		return false, nil
+	}
+
+	message := fmt.Sprintf("population timed out after %s", timeout)
+	return true, c.attemptFailed(ctx, key, pvc, ds, source, pod, pvcPrime, retryPolicy, metricLabels, reasonPopulatorTimeout, message)
+}
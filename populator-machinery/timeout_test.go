@@ -0,0 +1,215 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator_machinery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSourceTimeout(t *testing.T) {
+	c, _, _, _, _, _ := initTest()
+	c.populationTimeout = time.Hour
+
+	tests := []struct {
+		name       string
+		annotation string
+		expected   time.Duration
+	}{
+		{
+			name:     "Default",
+			expected: time.Hour,
+		},
+		{
+			name:       "Override",
+			annotation: "30m",
+			expected:   30 * time.Minute,
+		},
+		{
+			name:       "No limit",
+			annotation: "0s",
+			expected:   0,
+		},
+		{
+			name:       "Invalid",
+			annotation: "soon",
+			expected:   time.Hour,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := ust()
+			if test.annotation != "" {
+				source.SetAnnotations(map[string]string{c.timeoutAnno: test.annotation})
+			}
+			if got := c.sourceTimeout(source); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSyncPvcPodDeadline(t *testing.T) {
+	claim := pvc(testPvcName, testPvcNamespace, testNodeName, testStorageClassName, "",
+		dsf(testApiGroup, testDatasourceKind, testDataSourceName, testPvcNamespace), "")
+	c, _ := initSyncTest(t, claim, ust(), sc())
+	c.populationTimeout = 90 * time.Second
+
+	if err := syncTestPvc(c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	got, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get pod failed: %v", err)
+	}
+	if got.Spec.ActiveDeadlineSeconds == nil || *got.Spec.ActiveDeadlineSeconds != 90 {
+		t.Errorf("Expected deadline of 90s, got %v", got.Spec.ActiveDeadlineSeconds)
+	}
+}
+
+func TestSyncPvcTimeout(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+
+	tests := []struct {
+		name         string
+		provider     bool
+		created      metav1.Time
+		podPhase     corev1.PodPhase
+		podReason    string
+		handedOver   bool
+		policy       RetryPolicy
+		expectReason string
+		expectFailed bool
+	}{
+		{
+			name:     "Within timeout",
+			created:  metav1.Now(),
+			podPhase: corev1.PodRunning,
+		},
+		{
+			name:         "Pod timed out",
+			created:      old,
+			podPhase:     corev1.PodPending,
+			expectReason: reasonPopulatorTimeout,
+		},
+		{
+			name:         "Pod deadline exceeded",
+			created:      old,
+			podPhase:     corev1.PodFailed,
+			podReason:    podDeadlineExceeded,
+			expectReason: reasonPopulatorTimeout,
+		},
+		{
+			name:     "Pod succeeded after deadline",
+			created:  old,
+			podPhase: corev1.PodSucceeded,
+		},
+		{
+			name:       "Volume handed over",
+			created:    old,
+			podPhase:   corev1.PodSucceeded,
+			handedOver: true,
+		},
+		{
+			name:         "Provider timed out",
+			provider:     true,
+			created:      old,
+			expectReason: reasonPopulatorTimeout,
+		},
+		{
+			name:         "Provider retries exhausted",
+			provider:     true,
+			created:      old,
+			policy:       RetryPolicy{MaxAttempts: 1},
+			expectReason: reasonRetriesExhausted,
+			expectFailed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvcPrime := pvc(testPopulatorPvcName, testVpWorkingNamespace, "", testStorageClassName, testPvName, nil, corev1.ClaimBound)
+			pvcPrime.CreationTimestamp = test.created
+			objects := []runtime.Object{populatingPvc(), pvcPrime, ust(), sc()}
+			if !test.provider {
+				p := pod(test.podPhase)
+				p.CreationTimestamp = test.created
+				p.Status.Reason = test.podReason
+				objects = append(objects, p)
+			}
+			volume := pv(testPopulatorPvcName, testVpWorkingNamespace, "prime-uid")
+			if test.handedOver {
+				volume = pv(testPvcName, testPvcNamespace, testPvcUid)
+			}
+			objects = append(objects, volume)
+			c, recorder := initSyncTest(t, objects...)
+			c.populationTimeout = time.Hour
+			test.policy.setDefaults()
+			c.retryPolicy = test.policy
+			provider := &fakeProvider{}
+			if test.provider {
+				c.dataSources[schema.GroupKind{Group: testApiGroup, Kind: testDatasourceKind}].provider = provider.config()
+			}
+
+			if err := syncTestPvc(c); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if test.expectReason == "" {
+				if n := countEvents(recorder, reasonPopulatorTimeout); n != 0 {
+					t.Errorf("Expected no %s events, got %d", reasonPopulatorTimeout, n)
+				}
+			} else if n := countEvents(recorder, test.expectReason); n != 1 {
+				t.Errorf("Expected one %s event, got %d", test.expectReason, n)
+			}
+			if !test.provider {
+				_, err := c.kubeClient.CoreV1().Pods(testVpWorkingNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+				if (err != nil) != (test.expectReason != "") {
+					t.Errorf("Expected pod deleted %t, got error %v", test.expectReason != "", err)
+				}
+			} else {
+				// Providers populate PVC' in place, so another attempt needs
+				// a new one
+				_, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testVpWorkingNamespace).Get(context.TODO(), testPopulatorPvcName, metav1.GetOptions{})
+				if (err != nil) != (test.expectReason != "") {
+					t.Errorf("Expected PVC' deleted %t, got error %v", test.expectReason != "", err)
+				}
+			}
+			got, err := c.kubeClient.CoreV1().PersistentVolumeClaims(testPvcNamespace).Get(context.TODO(), testPvcName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get pvc failed: %v", err)
+			}
+			if _, failed := got.Annotations[c.failedAnno]; failed != test.expectFailed {
+				t.Errorf("Expected failed %t, got annotations %v", test.expectFailed, got.Annotations)
+			}
+			if test.expectReason != "" && got.Annotations[c.failureAnno] == "" {
+				t.Errorf("Expected the failure to be recorded, got annotations %v", got.Annotations)
+			}
+			if test.provider && provider.populateCalls != 0 {
+				t.Errorf("Expected no populate calls after the timeout, got %d", provider.populateCalls)
+			}
+		})
+	}
+}
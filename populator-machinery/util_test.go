@@ -7,6 +7,8 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 )
 
@@ -257,12 +259,17 @@ func TestIsGranted(t *testing.T) {
 	modified.referenceGrantTo = []gatewayv1beta1.ReferenceGrantTo{}
 	testcases = append(testcases, modified)
 
-	doit := func(t *testing.T, tc testcase) {
+	// version is the ReferenceGrant API version the grant is read from. With
+	// an empty version the v1beta1 object is used directly.
+	doit := func(t *testing.T, tc testcase, version string) {
 		var referenceGrantList []*gatewayv1beta1.ReferenceGrant
 		if tc.withoutreferenceGrants {
 			referenceGrantList = nil
 		} else {
 			referenceGrant := generateReferenceGrant(tc.refGrantsrcNamespace, tc.referenceGrantFrom, tc.referenceGrantTo)
+			if version != "" {
+				referenceGrant = convertReferenceGrant(t, referenceGrant, version)
+			}
 			referenceGrantList = append(referenceGrantList, referenceGrant)
 		}
 		claim := generatePVCForFromXnsdataSource(tc.pvcNamespace, tc.dataSourceRef, requestedBytes)
@@ -277,7 +284,29 @@ func TestIsGranted(t *testing.T) {
 
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
-			doit(t, *tc)
+			doit(t, *tc, "")
+			for _, version := range referenceGrantVersions {
+				t.Run(version, func(t *testing.T) {
+					doit(t, *tc, version)
+				})
+			}
 		})
 	}
 }
+
+// convertReferenceGrant round-trips a ReferenceGrant through the unstructured
+// form of the given API version, the way the controller reads it.
+func convertReferenceGrant(t *testing.T, grant *gatewayv1beta1.ReferenceGrant, version string) *gatewayv1beta1.ReferenceGrant {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(grant)
+	if err != nil {
+		t.Fatalf("Failed to convert ReferenceGrant: %v", err)
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetAPIVersion(gatewayv1beta1.GroupName + "/" + version)
+	obj.SetKind("ReferenceGrant")
+	converted, err := referenceGrantFromUnstructured(obj)
+	if err != nil {
+		t.Fatalf("Failed to read ReferenceGrant %s: %v", version, err)
+	}
+	return converted
+}